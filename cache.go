@@ -0,0 +1,96 @@
+package jwt_middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenCache is a bounded LRU cache of verified tokens, keyed by a hash of the raw token, so that repeated requests with the same token skip signature verification.
+type tokenCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// cachedToken is a verified token held in the tokenCache.
+type cachedToken struct {
+	hash    string
+	claims  jwt.MapClaims
+	header  map[string]interface{}
+	keyID   string // The ID of the dynamic key that verified the token, or empty if verified with the fixed secret
+	expires time.Time
+}
+
+// newTokenCache creates a tokenCache holding up to size tokens, or returns nil if size is not positive.
+func newTokenCache(size int) *tokenCache {
+	if size <= 0 {
+		return nil
+	}
+	return &tokenCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// hashToken returns the key used to cache the raw token.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// get returns the cached token for the hash if present and not expired.
+func (cache *tokenCache) get(hash string, now time.Time) (*cachedToken, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedToken)
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, hash)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+// add adds the token to the cache, evicting the least recently used token if the cache is full.
+func (cache *tokenCache) add(entry *cachedToken) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.entries[entry.hash]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	if cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedToken).hash)
+	}
+	cache.entries[entry.hash] = cache.order.PushFront(entry)
+}
+
+// removeKey removes all tokens verified by the given key, e.g. because the key has been dropped by its issuer.
+func (cache *tokenCache) removeKey(keyID string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for hash, element := range cache.entries {
+		if element.Value.(*cachedToken).keyID == keyID {
+			cache.order.Remove(element)
+			delete(cache.entries, hash)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/danwakefield/fnmatch"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ClaimMappingConfig is the configuration for a step of the claim mapping pipeline, which sets a claim from one or more source claims.
+type ClaimMappingConfig struct {
+	Issuers     []string `json:"issuers,omitempty"`
+	Claim       string   `json:"claim,omitempty"`
+	From        []string `json:"from,omitempty"`
+	Rename      bool     `json:"rename,omitempty"`
+	Split       string   `json:"split,omitempty"`
+	Lowercase   bool     `json:"lowercase,omitempty"`
+	StripPrefix string   `json:"stripPrefix,omitempty"`
+}
+
+// ClaimMapping is a step of the claim mapping pipeline.
+type ClaimMapping struct {
+	issuers     []string
+	claim       string
+	from        []string
+	rename      bool
+	split       string
+	lowercase   bool
+	stripPrefix string
+}
+
+// setupClaimMappings checks and converts the claim mapping configuration. Mappings without sources transform the claim in place.
+func setupClaimMappings(configs []ClaimMappingConfig) ([]ClaimMapping, error) {
+	mappings := make([]ClaimMapping, len(configs))
+	for index, config := range configs {
+		if config.Claim == "" {
+			return nil, fmt.Errorf("claim mapping %d: no claim given", index)
+		}
+		from := config.From
+		if len(from) == 0 {
+			from = []string{config.Claim}
+		}
+		mappings[index] = ClaimMapping{
+			issuers:     canonicalizeDomains(config.Issuers),
+			claim:       config.Claim,
+			from:        from,
+			rename:      config.Rename,
+			split:       config.Split,
+			lowercase:   config.Lowercase,
+			stripPrefix: config.StripPrefix,
+		}
+	}
+	return mappings, nil
+}
+
+// mapClaims returns the claims with the mappings for the token's issuer applied in order, so that later mappings see the results of earlier ones.
+// The claims are copied rather than modified, as they may be shared with the token cache.
+func (validator *Validator) mapClaims(claims jwt.MapClaims) jwt.MapClaims {
+	if len(validator.claimMappings) == 0 {
+		return claims
+	}
+
+	issuer, _ := claims["iss"].(string)
+	issuer = canonicalizeDomain(issuer)
+	var copied jwt.MapClaims
+	for _, mapping := range validator.claimMappings {
+		if !mapping.appliesTo(issuer) {
+			continue
+		}
+		if copied == nil {
+			copied = make(jwt.MapClaims, len(claims)+len(validator.claimMappings))
+			for key, value := range claims {
+				copied[key] = value
+			}
+		}
+		mapping.apply(copied)
+	}
+	if copied == nil {
+		return claims
+	}
+	return copied
+}
+
+// appliesTo returns true if the mapping applies to tokens from the (canonicalized) issuer.
+func (mapping ClaimMapping) appliesTo(issuer string) bool {
+	if len(mapping.issuers) == 0 {
+		return true
+	}
+	for _, allowed := range mapping.issuers {
+		if fnmatch.Match(allowed, issuer, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the mapping's claim from its source claims. The values of several sources are merged into an array without duplicates, as are arrays
+// and split strings, while a single string or other value is kept as is. If none of the sources are present the claim is left unchanged.
+// When renaming, top-level source claims are removed; nested sources are left in place.
+func (mapping ClaimMapping) apply(claims jwt.MapClaims) {
+	var values []interface{}
+	seen := make(map[string]bool)
+	array := len(mapping.from) > 1 || mapping.split != ""
+	found := false
+	for _, source := range mapping.from {
+		value, ok := lookupClaim(claims, source)
+		if !ok {
+			continue
+		}
+		found = true
+		elements, isArray := value.([]interface{})
+		if !isArray {
+			elements = []interface{}{value}
+		}
+		array = array || isArray
+		for _, element := range elements {
+			for _, element := range mapping.transform(element) {
+				if key, ok := element.(string); ok {
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+				}
+				values = append(values, element)
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	if mapping.rename {
+		for _, source := range mapping.from {
+			if source != mapping.claim {
+				delete(claims, source)
+			}
+		}
+	}
+	if !array && len(values) == 1 {
+		claims[mapping.claim] = values[0]
+	} else {
+		if values == nil {
+			values = []interface{}{}
+		}
+		claims[mapping.claim] = values
+	}
+}
+
+// transform splits, strips the prefix from and lowercases a string value. Other values are returned unchanged.
+func (mapping ClaimMapping) transform(value interface{}) []interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return []interface{}{value}
+	}
+	parts := []string{text}
+	if mapping.split != "" {
+		parts = strings.Split(text, mapping.split)
+	}
+	values := make([]interface{}, 0, len(parts))
+	for _, part := range parts {
+		if mapping.split != "" {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+		}
+		part = strings.TrimPrefix(part, mapping.stripPrefix)
+		if mapping.lowercase {
+			part = strings.ToLower(part)
+		}
+		values = append(values, part)
+	}
+	return values
+}
@@ -0,0 +1,84 @@
+package jwt_middleware
+
+import (
+	"strconv"
+	"strings"
+)
+
+// lookupClaim returns the value of the named claim. A name that exists as a top-level claim is always used as is, so that claims containing dots
+// (such as Auth0 namespaced claims) keep working. Otherwise, a name beginning with / is a JSON Pointer (RFC 6901) and any other name is a path
+// of dot-separated segments in which \. is a literal dot, e.g. realm_access.roles or https://example\.com/roles.
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	return resolveClaimPath(claims, splitClaimPath(name))
+}
+
+// splitClaimPath splits a JSON Pointer or dotted claim path into its segments.
+func splitClaimPath(name string) []string {
+	if strings.HasPrefix(name, "/") {
+		segments := strings.Split(name[1:], "/")
+		for index, segment := range segments {
+			segments[index] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		}
+		return segments
+	}
+
+	var segments []string
+	var segment strings.Builder
+	for index := 0; index < len(name); index++ {
+		switch {
+		case name[index] == '\\' && index+1 < len(name) && name[index+1] == '.':
+			segment.WriteByte('.')
+			index++
+		case name[index] == '.':
+			segments = append(segments, segment.String())
+			segment.Reset()
+		default:
+			segment.WriteByte(name[index])
+		}
+	}
+	return append(segments, segment.String())
+}
+
+// resolveClaimPath walks the path through nested objects and arrays. A numeric segment indexes an array, while any other segment
+// applied to an array is resolved against each element and the results are collected, e.g. groups.name on [{"name": "a"}, {"name": "b"}].
+func resolveClaimPath(value interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return value, true
+	}
+	segment := path[0]
+	switch value := value.(type) {
+	case map[string]interface{}:
+		nested, ok := value[segment]
+		if !ok {
+			return nil, false
+		}
+		return resolveClaimPath(nested, path[1:])
+	case []interface{}:
+		if index, err := strconv.Atoi(segment); err == nil {
+			if index < 0 || index >= len(value) {
+				return nil, false
+			}
+			return resolveClaimPath(value[index], path[1:])
+		}
+		var collected []interface{}
+		for _, element := range value {
+			nested, ok := resolveClaimPath(element, path)
+			if !ok {
+				continue
+			}
+			if values, ok := nested.([]interface{}); ok {
+				collected = append(collected, values...)
+			} else {
+				collected = append(collected, nested)
+			}
+		}
+		if collected == nil {
+			return nil, false
+		}
+		return collected, true
+	}
+	return nil, false
+}
@@ -0,0 +1,52 @@
+package jwt_middleware
+
+import (
+	"context"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token sources, as reported in ValidationResult and configured in tokenSources.
+const (
+	TokenSourceCookie    = "cookie"
+	TokenSourceHeader    = "header"
+	TokenSourceQuery     = "query"
+	TokenSourceForm      = "form"
+	TokenSourceWebSocket = "websocket"
+)
+
+// ValidationResult is the result of successfully validating a request's token. It's attached to the context of the request passed to the next handler,
+// so that Go handlers using the plugin as net/http middleware can access the claims without them being round-tripped through headers.
+// The claims and header may be shared with the token cache, so must not be modified.
+type ValidationResult struct {
+	Claims jwt.MapClaims          // The claims, after any claim mappings and role permissions have been applied
+	Token  string                 // The raw token, as presented
+	Header map[string]interface{} // The JOSE header of the token, or nil if it was introspected
+	Issuer string                 // The issuer whose keys verified the token, or empty if it was verified with the fixed secret or introspected
+	KeyID  string                 // The kid of the key that verified the token, if any
+	Source string                 // Where the token was found, as returned by the Extractor's Source
+}
+
+// resultContextKey is the key of the ValidationResult in a request context.
+type resultContextKey struct{}
+
+// contextWithResult returns a copy of the context carrying the result.
+func contextWithResult(parent context.Context, result *ValidationResult) context.Context {
+	return context.WithValue(parent, resultContextKey{}, result)
+}
+
+// ResultFromContext returns the ValidationResult attached to a request context by the plugin, if any.
+// There is no result if the request was allowed without a token because the token is optional.
+func ResultFromContext(ctx context.Context) (*ValidationResult, bool) {
+	result, ok := ctx.Value(resultContextKey{}).(*ValidationResult)
+	return result, ok
+}
+
+// ClaimsFromContext returns the claims of the token validated by the plugin for a request context, if any.
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	result, ok := ResultFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	return result.Claims, true
+}
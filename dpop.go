@@ -0,0 +1,162 @@
+package jwt_middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// dpopMethods returns the asymmetric algorithms from validMethods, as a DPoP proof can never be signed with a shared secret.
+func dpopMethods(validMethods []string) []string {
+	methods := make([]string, 0, len(validMethods))
+	for _, method := range validMethods {
+		if !strings.HasPrefix(method, "HS") {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// validateDPoP checks the DPoP proof for the request and that the access token is bound to the proof's key, as per RFC 9449.
+func (validator *Validator) validateDPoP(request *http.Request, variables *TemplateVariables, token string, scheme string, claims jwt.MapClaims) error {
+	confirmation, _ := claims["cnf"].(map[string]interface{})
+	thumbprint, bound := confirmation["jkt"].(string)
+
+	if scheme != "DPoP" {
+		if validator.requireDPoP {
+			return fmt.Errorf("DPoP proof required")
+		}
+		if bound && validator.dpop {
+			return fmt.Errorf("DPoP-bound token must use the DPoP authorization scheme")
+		}
+		return nil
+	}
+	if !validator.dpop {
+		return fmt.Errorf("DPoP is not supported")
+	}
+
+	proofs := request.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return fmt.Errorf("exactly one DPoP proof is required")
+	}
+	proof, jwk, err := validator.parseDPoPProof(proofs[0])
+	if err != nil {
+		return fmt.Errorf("invalid DPoP proof: %w", err)
+	}
+	proofClaims := proof.Claims.(jwt.MapClaims)
+
+	if method, _ := proofClaims["htm"].(string); method != request.Method {
+		return fmt.Errorf("DPoP proof htm does not match request: %s", method)
+	}
+	if target, _ := proofClaims["htu"].(string); !matchesTargetURI(target, variables) {
+		return fmt.Errorf("DPoP proof htu does not match request: %s", target)
+	}
+
+	issued, ok := proofClaims["iat"].(float64)
+	if !ok {
+		return fmt.Errorf("DPoP proof iat is missing")
+	}
+	now := validator.now()
+	if math.Abs(float64(now.Unix())-issued) > float64(validator.dpopWindow) {
+		return fmt.Errorf("DPoP proof iat is outside the acceptable window")
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	if hashed, _ := proofClaims["ath"].(string); hashed != base64.RawURLEncoding.EncodeToString(hash[:]) {
+		return fmt.Errorf("DPoP proof ath does not match access token")
+	}
+
+	if !bound || thumbprint != JWKThumbprint(jwk) {
+		return fmt.Errorf("access token is not bound to the DPoP proof key")
+	}
+
+	identifier, _ := proofClaims["jti"].(string)
+	if identifier == "" {
+		return fmt.Errorf("DPoP proof jti is missing")
+	}
+	if !validator.recordDPoPProof(identifier, now) {
+		return fmt.Errorf("DPoP proof has already been used")
+	}
+
+	return nil
+}
+
+// parseDPoPProof verifies the proof's signature using the public key embedded in its header and returns the parsed proof and that key.
+func (validator *Validator) parseDPoPProof(proof string) (*jwt.Token, JSONWebKey, error) {
+	var jwk JSONWebKey
+	parsed, err := validator.dpopParser.Parse(proof, func(token *jwt.Token) (interface{}, error) {
+		if kind, _ := token.Header["typ"].(string); kind != "dpop+jwt" {
+			return nil, fmt.Errorf("typ must be dpop+jwt")
+		}
+		embedded, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("jwk header is missing")
+		}
+		encoded, err := json.Marshal(embedded)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(encoded, &jwk)
+		if err != nil {
+			return nil, err
+		}
+		if jwk.D != "" {
+			return nil, fmt.Errorf("jwk header must not contain a private key")
+		}
+		key := JWKPublicKey(jwk)
+		if key == nil {
+			return nil, fmt.Errorf("jwk header is not a supported public key")
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, jwk, err
+	}
+	return parsed, jwk, nil
+}
+
+// matchesTargetURI compares the htu claim to the request URL, ignoring any query and fragment.
+func matchesTargetURI(target string, variables *TemplateVariables) bool {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	path, _, _ := strings.Cut(variables.Path, "?")
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	if path == "" {
+		path = "/"
+	}
+	return strings.EqualFold(parsed.Scheme, variables.Scheme) && strings.EqualFold(parsed.Host, variables.Host) && parsed.Path == path
+}
+
+// recordDPoPProof records the proof's jti so that it can't be replayed, returning false if it has already been seen within the acceptable window.
+func (validator *Validator) recordDPoPProof(identifier string, now time.Time) bool {
+	validator.dpopLock.Lock()
+	defer validator.dpopLock.Unlock()
+
+	// Periodically forget proofs that could no longer be replayed as they are outside the window
+	if now.Sub(validator.dpopPurged) > time.Duration(validator.dpopWindow)*time.Second {
+		for seen, expires := range validator.dpopProofs {
+			if now.After(expires) {
+				delete(validator.dpopProofs, seen)
+			}
+		}
+		validator.dpopPurged = now
+	}
+	if expires, ok := validator.dpopProofs[identifier]; ok && !now.After(expires) {
+		return false
+	}
+	// A proof is acceptable for the window either side of its iat, so must be remembered for twice that
+	validator.dpopProofs[identifier] = now.Add(2 * time.Duration(validator.dpopWindow) * time.Second)
+	return true
+}
@@ -0,0 +1,373 @@
+package jwt_middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Extractor extracts a token from a request. Library users may implement their own and pass them to NewValidator with WithExtractors.
+type Extractor interface {
+	// Extract returns the token in the request and any authorization scheme with which it was given, or an empty token if there is none.
+	// The request must be left as it was found.
+	Extract(request *http.Request) (string, string)
+	// Remove removes the token from the request, so that it isn't forwarded to the backend.
+	Remove(request *http.Request)
+	// Source returns where the extractor finds tokens, as reported in ValidationResult.
+	Source() string
+}
+
+// TokenSourceConfig is the configuration for a source of tokens. Name is the cookie, header, query or form parameter name, or the marker subprotocol
+// for websockets. Prefixes are the authorization schemes accepted in headers. MaxChunks is the maximum number of chunks of a chunked cookie.
+type TokenSourceConfig struct {
+	Type      string   `json:"type,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Prefixes  []string `json:"prefixes,omitempty"`
+	MaxChunks int      `json:"maxChunks,omitempty"`
+}
+
+// DefaultHeaderPrefixes are the authorization schemes accepted in headers when none are configured.
+var DefaultHeaderPrefixes = []string{"Bearer", "DPoP"}
+
+// DefaultMaxCookieChunks is the maximum number of chunks of a chunked cookie when no maximum is configured.
+const DefaultMaxCookieChunks = 10
+
+// maxFormSize is the largest form body from which tokens are extracted, matching the limit of http.Request.ParseForm.
+const maxFormSize = 10 << 20
+
+// setupExtractors creates the extractors for the configured token sources, or from cookieName, headerName and parameterName, in that order, if there are none.
+func setupExtractors(config *Config) ([]Extractor, error) {
+	if len(config.TokenSources) == 0 {
+		var extractors []Extractor
+		if config.CookieName != "" {
+			extractors = append(extractors, NewCookieExtractor(config.CookieName))
+		}
+		if config.HeaderName != "" {
+			extractors = append(extractors, NewHeaderExtractor(config.HeaderName, DefaultHeaderPrefixes...))
+		}
+		if config.ParameterName != "" {
+			extractors = append(extractors, NewQueryExtractor(config.ParameterName))
+		}
+		return extractors, nil
+	}
+
+	extractors := make([]Extractor, len(config.TokenSources))
+	for index, source := range config.TokenSources {
+		switch strings.ToLower(source.Type) {
+		case TokenSourceCookie:
+			maxChunks := source.MaxChunks
+			if maxChunks == 0 {
+				maxChunks = DefaultMaxCookieChunks
+			}
+			extractors[index] = &cookieExtractor{name: withDefaultName(source.Name, "Authorization"), maxChunks: maxChunks}
+		case TokenSourceHeader:
+			extractors[index] = NewHeaderExtractor(withDefaultName(source.Name, "Authorization"), withDefault(source.Prefixes, DefaultHeaderPrefixes)...)
+		case TokenSourceQuery:
+			extractors[index] = NewQueryExtractor(withDefaultName(source.Name, "access_token"))
+		case TokenSourceForm:
+			extractors[index] = NewFormExtractor(withDefaultName(source.Name, "access_token"))
+		case TokenSourceWebSocket:
+			extractors[index] = NewWebSocketExtractor(withDefaultName(source.Name, "access_token"))
+		default:
+			return nil, fmt.Errorf("token source %d: unknown type: %s", index, source.Type)
+		}
+	}
+	return extractors, nil
+}
+
+// withDefaultName returns name, or the default if no name is given.
+func withDefaultName(name string, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// extractToken extracts the token from the request using the first extractor that finds one, returning the token, any authorization scheme
+// and the extractor.
+func (validator *Validator) extractToken(request *http.Request) (string, string, Extractor) {
+	for _, extractor := range validator.extractors {
+		if token, scheme := extractor.Extract(request); token != "" {
+			return token, scheme, extractor
+		}
+	}
+	return "", "", nil
+}
+
+// cookieExtractor extracts tokens from a cookie, or from a cookie split into chunks named name.0, name.1 and so on, for tokens exceeding the size
+// limit of cookies. The cookie itself may give the number of chunks as chunks-N.
+type cookieExtractor struct {
+	name      string
+	maxChunks int
+}
+
+// NewCookieExtractor returns an Extractor for the named cookie, which may be chunked into at most DefaultMaxCookieChunks chunks.
+func NewCookieExtractor(name string) Extractor {
+	return &cookieExtractor{name: name, maxChunks: DefaultMaxCookieChunks}
+}
+
+// Extract returns the value of the cookie, or of its chunks joined in order.
+func (extractor *cookieExtractor) Extract(request *http.Request) (string, string) {
+	cookie, err := request.Cookie(extractor.name)
+	if err != nil {
+		return extractor.join(request, 0), ""
+	}
+	count, chunked := strings.CutPrefix(cookie.Value, "chunks-")
+	if !chunked {
+		return cookie.Value, ""
+	}
+	expected, err := strconv.Atoi(count)
+	if err != nil || expected < 1 {
+		return "", ""
+	}
+	return extractor.join(request, expected), ""
+}
+
+// join returns the chunks of the cookie joined in order, or an empty string if there are no chunks, more than maxChunks, a gap in the chunks,
+// or a number other than expected (if given).
+func (extractor *cookieExtractor) join(request *http.Request, expected int) string {
+	chunks := make(map[int]string)
+	for _, cookie := range request.Cookies() {
+		index, ok := extractor.chunkIndex(cookie.Name)
+		if !ok {
+			continue
+		}
+		if index >= extractor.maxChunks {
+			return ""
+		}
+		if _, ok := chunks[index]; !ok {
+			chunks[index] = cookie.Value
+		}
+	}
+	if expected != 0 && len(chunks) != expected {
+		return ""
+	}
+
+	var joined strings.Builder
+	for index := 0; index < len(chunks); index++ {
+		chunk, ok := chunks[index]
+		if !ok {
+			return ""
+		}
+		joined.WriteString(chunk)
+	}
+	return joined.String()
+}
+
+// chunkIndex returns the index of the chunk if the name is that of a chunk of the cookie.
+func (extractor *cookieExtractor) chunkIndex(name string) (int, bool) {
+	suffix, ok := strings.CutPrefix(name, extractor.name+".")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(suffix)
+	if err != nil || index < 0 || strconv.Itoa(index) != suffix {
+		return 0, false
+	}
+	return index, true
+}
+
+// Remove removes the cookie and all of its chunks, keeping any others.
+func (extractor *cookieExtractor) Remove(request *http.Request) {
+	cookies := request.Cookies()
+	request.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if _, chunk := extractor.chunkIndex(cookie.Name); cookie.Name != extractor.name && !chunk {
+			request.AddCookie(cookie)
+		}
+	}
+}
+
+// Source returns TokenSourceCookie.
+func (extractor *cookieExtractor) Source() string {
+	return TokenSourceCookie
+}
+
+// headerExtractor extracts tokens from a header, optionally prefixed by an authorization scheme.
+type headerExtractor struct {
+	name     string
+	prefixes []string
+}
+
+// NewHeaderExtractor returns an Extractor for the named header. The token may be prefixed by any of the authorization schemes, which are matched
+// case-insensitively and returned as given here. A value without a known scheme is taken to be the token.
+func NewHeaderExtractor(name string, prefixes ...string) Extractor {
+	return &headerExtractor{name: http.CanonicalHeaderKey(name), prefixes: prefixes}
+}
+
+// Extract returns the value of the header without any scheme, and the scheme.
+func (extractor *headerExtractor) Extract(request *http.Request) (string, string) {
+	value := request.Header.Get(extractor.name)
+	for _, prefix := range extractor.prefixes {
+		if len(value) > len(prefix) && value[len(prefix)] == ' ' && strings.EqualFold(value[:len(prefix)], prefix) {
+			return strings.TrimLeft(value[len(prefix)+1:], " "), prefix
+		}
+	}
+	return value, ""
+}
+
+// Remove removes the header.
+func (extractor *headerExtractor) Remove(request *http.Request) {
+	request.Header.Del(extractor.name)
+}
+
+// Source returns TokenSourceHeader.
+func (extractor *headerExtractor) Source() string {
+	return TokenSourceHeader
+}
+
+// queryExtractor extracts tokens from a query parameter.
+type queryExtractor struct {
+	name string
+}
+
+// NewQueryExtractor returns an Extractor for the named query parameter.
+func NewQueryExtractor(name string) Extractor {
+	return &queryExtractor{name: name}
+}
+
+// Extract returns the value of the query parameter.
+func (extractor *queryExtractor) Extract(request *http.Request) (string, string) {
+	return request.URL.Query().Get(extractor.name), ""
+}
+
+// Remove removes the query parameter.
+func (extractor *queryExtractor) Remove(request *http.Request) {
+	query := request.URL.Query()
+	query.Del(extractor.name)
+	request.URL.RawQuery = query.Encode()
+	request.RequestURI = request.URL.RequestURI()
+}
+
+// Source returns TokenSourceQuery.
+func (extractor *queryExtractor) Source() string {
+	return TokenSourceQuery
+}
+
+// formExtractor extracts tokens from a parameter of a form encoded body, as per RFC 6750 section 2.2.
+type formExtractor struct {
+	name string
+}
+
+// NewFormExtractor returns an Extractor for the named parameter of application/x-www-form-urlencoded request bodies. GET requests are ignored.
+func NewFormExtractor(name string) Extractor {
+	return &formExtractor{name: name}
+}
+
+// Extract returns the value of the form parameter. The body is read and then restored, so that it can still be read by the backend.
+func (extractor *formExtractor) Extract(request *http.Request) (string, string) {
+	form, ok := readForm(request)
+	if !ok {
+		return "", ""
+	}
+	return form.Get(extractor.name), ""
+}
+
+// Remove removes the form parameter from the body.
+func (extractor *formExtractor) Remove(request *http.Request) {
+	form, ok := readForm(request)
+	if !ok {
+		return
+	}
+	form.Del(extractor.name)
+	body := form.Encode()
+	request.Body = io.NopCloser(strings.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// Source returns TokenSourceForm.
+func (extractor *formExtractor) Source() string {
+	return TokenSourceForm
+}
+
+// readForm parses the form encoded body of a request other than a GET and then restores it. Bodies larger than maxFormSize are not parsed.
+func readForm(request *http.Request) (url.Values, bool) {
+	if request.Method == http.MethodGet || request.Body == nil || request.Body == http.NoBody {
+		return nil, false
+	}
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxFormSize+1))
+	if err != nil {
+		return nil, false
+	}
+	if len(body) > maxFormSize {
+		request.Body = readCloser{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return nil, false
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false
+	}
+	return form, true
+}
+
+// readCloser reads from a reader but closes the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// webSocketExtractor extracts tokens from the Sec-WebSocket-Protocol header, as browsers can't set other headers on websocket connections.
+type webSocketExtractor struct {
+	marker string
+}
+
+// NewWebSocketExtractor returns an Extractor for tokens given as the subprotocol following the marker subprotocol in the Sec-WebSocket-Protocol header,
+// e.g. new WebSocket(url, ["access_token", token]).
+func NewWebSocketExtractor(marker string) Extractor {
+	return &webSocketExtractor{marker: marker}
+}
+
+// Extract returns the subprotocol following the marker.
+func (extractor *webSocketExtractor) Extract(request *http.Request) (string, string) {
+	protocols := webSocketProtocols(request)
+	for index := 0; index+1 < len(protocols); index++ {
+		if protocols[index] == extractor.marker {
+			return protocols[index+1], ""
+		}
+	}
+	return "", ""
+}
+
+// Remove removes the token from the subprotocols. The marker is kept, so that the backend can accept it as the subprotocol, as browsers require.
+func (extractor *webSocketExtractor) Remove(request *http.Request) {
+	protocols := webSocketProtocols(request)
+	kept := make([]string, 0, len(protocols))
+	for index, protocol := range protocols {
+		if index > 0 && protocols[index-1] == extractor.marker {
+			continue
+		}
+		kept = append(kept, protocol)
+	}
+	request.Header.Set("Sec-WebSocket-Protocol", strings.Join(kept, ", "))
+}
+
+// Source returns TokenSourceWebSocket.
+func (extractor *webSocketExtractor) Source() string {
+	return TokenSourceWebSocket
+}
+
+// webSocketProtocols returns the subprotocols requested by a websocket handshake.
+func webSocketProtocols(request *http.Request) []string {
+	var protocols []string
+	for _, value := range request.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
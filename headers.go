@@ -0,0 +1,231 @@
+package jwt_middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Header formats for claims forwarded with headers.
+const (
+	HeaderFormatJoin       = "join"       // Strings as is, numbers without exponents, arrays joined with the separator and objects as JSON (the default)
+	HeaderFormatJSON       = "json"       // JSON
+	HeaderFormatBase64JSON = "base64json" // Base64 (standard encoding) of the JSON
+)
+
+// HeaderConfig is the configuration for a header set from the claims or token header. Without a claim, the json and base64json formats encode all claims.
+type HeaderConfig struct {
+	Claim     string `json:"claim,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Separator string `json:"separator,omitempty"`
+	Template  string `json:"template,omitempty"`
+}
+
+// Header is a header set from the claims or token header.
+type Header struct {
+	claim     string
+	format    string
+	separator string
+	template  *template.Template
+}
+
+// HeaderVariables are the variables passed to header templates.
+type HeaderVariables struct {
+	Claims map[string]interface{}
+	Header map[string]interface{} // The JOSE header of the token, or empty for introspected tokens
+	Issuer string                 // The issuer whose keys verified the token, or empty if verified with the fixed secret or introspected
+}
+
+// headerFunctions are the functions available to header templates, in addition to the Go template builtins.
+var headerFunctions = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+	"join": func(separator string, value interface{}) string {
+		return formatHeaderValue(value, separator)
+	},
+}
+
+// setupHeaders checks and compiles the headers configuration.
+func setupHeaders(configs map[string]HeaderConfig) (map[string]*Header, error) {
+	headers := make(map[string]*Header, len(configs))
+	for name, config := range configs {
+		header := Header{claim: config.Claim, format: strings.ToLower(config.Format), separator: config.Separator}
+		if header.format == "" {
+			header.format = HeaderFormatJoin
+		}
+		if header.separator == "" {
+			header.separator = ","
+		}
+
+		switch {
+		case config.Template != "":
+			if config.Claim != "" {
+				return nil, fmt.Errorf("header %s: both claim and template given", name)
+			}
+			compiled, err := template.New(name).Funcs(headerFunctions).Parse(config.Template)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", name, err)
+			}
+			header.template = compiled
+		case header.format != HeaderFormatJoin && header.format != HeaderFormatJSON && header.format != HeaderFormatBase64JSON:
+			return nil, fmt.Errorf("header %s: unknown format: %s", name, config.Format)
+		case config.Claim == "" && header.format == HeaderFormatJoin:
+			return nil, fmt.Errorf("header %s: no claim or template given", name)
+		}
+		headers[http.CanonicalHeaderKey(name)] = &header
+	}
+	return headers, nil
+}
+
+// setupStripHeaders returns the canonical names of the headers to remove from incoming requests: those set from claims or with a minted token, and any others configured.
+func setupStripHeaders(config *Config, headers map[string]*Header, minter *Minter) []string {
+	names := make(map[string]bool)
+	if minter != nil {
+		names[minter.header] = true
+	}
+	for header := range config.HeaderMap {
+		names[http.CanonicalHeaderKey(header)] = true
+	}
+	for header := range headers {
+		names[header] = true
+	}
+	for _, header := range config.StripHeaders {
+		names[http.CanonicalHeaderKey(header)] = true
+	}
+	return sortedKeys(names)
+}
+
+// setupStripHeaderPrefixes returns the lowercased prefixes of headers to remove from incoming requests.
+func setupStripHeaderPrefixes(prefixes []string) []string {
+	lowered := make([]string, len(prefixes))
+	for index, prefix := range prefixes {
+		lowered[index] = strings.ToLower(prefix)
+	}
+	return lowered
+}
+
+// removeHeaders removes the headers that we set from claims, and any others configured, from the incoming request, so that the backend can trust them.
+func (plugin *JWTPlugin) removeHeaders(request *http.Request) {
+	for _, header := range plugin.stripHeaders {
+		request.Header.Del(header)
+	}
+	if len(plugin.stripHeaderPrefixes) == 0 {
+		return
+	}
+	for header := range request.Header {
+		lowered := strings.ToLower(header)
+		for _, prefix := range plugin.stripHeaderPrefixes {
+			if strings.HasPrefix(lowered, prefix) {
+				delete(request.Header, header)
+				break
+			}
+		}
+	}
+}
+
+// setHeaders sets the headers from headerMap and headers on the request to be forwarded to the backend.
+func (plugin *JWTPlugin) setHeaders(request *http.Request, claims map[string]interface{}, tokenHeader map[string]interface{}) {
+	for header, claim := range plugin.headerMap {
+		value, ok := lookupClaim(claims, claim)
+		if ok {
+			request.Header.Add(header, sanitizeHeaderValue(fmt.Sprint(value)))
+		}
+	}
+
+	var variables *HeaderVariables
+	for name, header := range plugin.headers {
+		var value string
+		var ok bool
+		var err error
+		if header.template != nil {
+			if variables == nil {
+				variables = &HeaderVariables{Claims: claims, Header: tokenHeader, Issuer: plugin.keyIssuer(tokenHeader)}
+			}
+			value, err = header.expand(variables)
+			ok = err == nil
+		} else {
+			value, ok, err = header.formatClaims(claims)
+		}
+		if err != nil {
+			plugin.logger.Printf("failed to set header %s: %v", name, err)
+		} else if ok && value != "" {
+			request.Header.Add(name, sanitizeHeaderValue(value))
+		}
+	}
+}
+
+// expand executes the header's template.
+func (header *Header) expand(variables *HeaderVariables) (string, error) {
+	var buffer bytes.Buffer
+	err := header.template.Execute(&buffer, variables)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand header template: %w", err)
+	}
+	return buffer.String(), nil
+}
+
+// formatClaims formats the header's claim, or all claims if no claim is given, returning false if the claim is not present.
+func (header *Header) formatClaims(claims map[string]interface{}) (string, bool, error) {
+	var value interface{} = claims
+	if header.claim != "" {
+		var ok bool
+		value, ok = lookupClaim(claims, header.claim)
+		if !ok {
+			return "", false, nil
+		}
+	}
+
+	if header.format == HeaderFormatJoin {
+		return formatHeaderValue(value, header.separator), true, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to encode header: %w", err)
+	}
+	if header.format == HeaderFormatBase64JSON {
+		return base64.StdEncoding.EncodeToString(encoded), true, nil
+	}
+	return string(encoded), true, nil
+}
+
+// formatHeaderValue formats a claim value as text: strings as is, numbers without exponents, arrays joined with the separator and objects as JSON.
+func formatHeaderValue(value interface{}, separator string) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []interface{}:
+		values := make([]string, len(value))
+		for index, element := range value {
+			values[index] = formatHeaderValue(element, separator)
+		}
+		return strings.Join(values, separator)
+	case map[string]interface{}:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// sanitizeHeaderValue replaces CR, LF and other control characters (other than tab) with spaces, so that claims can't inject headers.
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(character rune) rune {
+		if (character < 0x20 && character != '\t') || character == 0x7f {
+			return ' '
+		}
+		return character
+	}, value)
+}
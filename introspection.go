@@ -0,0 +1,112 @@
+package jwt_middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultIntrospectionCacheSize is the maximum number of introspection results cached when no size is configured.
+const DefaultIntrospectionCacheSize = 1000
+
+// inactiveIntrospectionTTL is the longest that inactive introspection results are cached, so that repeated unknown tokens don't each cost a request
+// to the endpoint, while tokens that become active soon after aren't rejected for long.
+const inactiveIntrospectionTTL = 10 * time.Second
+
+// isJWT returns true if the token looks like a compact JWS or JWE rather than an opaque reference token.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 || isEncrypted(token)
+}
+
+// shouldIntrospect returns true if the token should be validated by the introspection endpoint rather than parsed locally.
+func (validator *Validator) shouldIntrospect(token string) bool {
+	return validator.introspectionURL != "" && (validator.introspectAll || !isJWT(token))
+}
+
+// introspect returns the claims for the token from the cache, or from the introspection endpoint as per RFC 7662 if not cached.
+// Inactive results are cached briefly, as inactiveIntrospectionTTL, with nil claims.
+func (validator *Validator) introspect(token string) (jwt.MapClaims, error) {
+	hash := hashToken(token)
+	now := validator.now()
+
+	if validator.introspectionCache != nil {
+		if cached, ok := validator.introspectionCache.get(hash, now); ok {
+			if cached.claims == nil {
+				return nil, fmt.Errorf("token is not active")
+			}
+			return cached.claims, nil
+		}
+	}
+
+	claims, err := validator.fetchIntrospection(token)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(validator.introspectionCacheTTL) * time.Second
+	active, _ := claims["active"].(bool)
+	if !active {
+		if ttl > inactiveIntrospectionTTL {
+			ttl = inactiveIntrospectionTTL
+		}
+		validator.cacheIntrospection(hash, nil, now.Add(ttl))
+		return nil, fmt.Errorf("token is not active")
+	}
+
+	expires := now.Add(ttl)
+	if exp, ok := claims["exp"].(float64); ok {
+		expiry := time.Unix(int64(exp), 0)
+		if !now.Before(expiry) {
+			return nil, fmt.Errorf("token is expired")
+		}
+		if expiry.Before(expires) {
+			expires = expiry
+		}
+	}
+	validator.cacheIntrospection(hash, claims, expires)
+
+	return claims, nil
+}
+
+// cacheIntrospection caches the claims of an introspected token, or nil for an inactive token, until expires, if caching is enabled.
+func (validator *Validator) cacheIntrospection(hash string, claims jwt.MapClaims, expires time.Time) {
+	if validator.introspectionCache != nil {
+		validator.introspectionCache.add(&cachedToken{hash: hash, claims: claims, expires: expires})
+	}
+}
+
+// fetchIntrospection POSTs the token to the introspection endpoint, authenticating with the configured client credentials.
+func (validator *Validator) fetchIntrospection(token string) (jwt.MapClaims, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest(http.MethodPost, validator.introspectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if validator.introspectionClientID != "" {
+		// RFC 6749 requires the credentials to be form encoded before being used for basic authentication
+		request.SetBasicAuth(url.QueryEscape(validator.introspectionClientID), url.QueryEscape(validator.introspectionClientSecret))
+	}
+
+	response, err := validator.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", response.StatusCode, validator.introspectionURL)
+	}
+
+	var claims jwt.MapClaims
+	err = json.NewDecoder(response.Body).Decode(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", validator.introspectionURL, err)
+	}
+	return claims, nil
+}
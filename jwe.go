@@ -0,0 +1,108 @@
+package jwt_middleware
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// DefaultKeyManagementAlgorithms are the JWE alg values accepted when none are configured.
+var DefaultKeyManagementAlgorithms = []string{"RSA-OAEP", "RSA-OAEP-256", "ECDH-ES", "ECDH-ES+A128KW", "ECDH-ES+A192KW", "ECDH-ES+A256KW", "dir"}
+
+// DefaultContentEncryptionAlgorithms are the JWE enc values accepted when none are configured.
+var DefaultContentEncryptionAlgorithms = []string{"A128GCM", "A192GCM", "A256GCM", "A128CBC-HS256", "A192CBC-HS384", "A256CBC-HS512"}
+
+// SetupDecryptionKeys converts the configured PEM-encoded private keys or symmetric secrets to keys usable for decrypting JWE tokens.
+func SetupDecryptionKeys(keys []string) ([]interface{}, error) {
+	converted := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "-----BEGIN") {
+			// We assume it's a symmetric key for direct ("dir") encryption
+			converted = append(converted, []byte(key))
+			continue
+		}
+		block, _ := pem.Decode([]byte(key))
+		if block == nil {
+			return nil, fmt.Errorf("invalid decryption key: not PEM encoded")
+		}
+		private, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decryption key: %w", err)
+		}
+		converted = append(converted, private)
+	}
+	return converted, nil
+}
+
+// parsePrivateKey parses a PEM block containing a PKCS #1 RSA, SEC 1 EC or PKCS #8 private key.
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM type %s", block.Type)
+}
+
+// isEncrypted returns true if the token is in the five part JWE compact serialization rather than the three part JWS one.
+func isEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// decryptToken decrypts a JWE compact token with the configured decryption keys and returns the nested JWS it contains.
+func (validator *Validator) decryptToken(token string) (string, error) {
+	if len(validator.decryptionKeys) == 0 {
+		return "", fmt.Errorf("encrypted tokens are not supported")
+	}
+
+	encrypted, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted token: %w", err)
+	}
+
+	algorithm := encrypted.Header.Algorithm
+	if !contains(validator.keyManagementAlgorithms, algorithm) {
+		return "", fmt.Errorf("encrypted token alg is not allowed: %s", algorithm)
+	}
+	encryption, _ := encrypted.Header.ExtraHeaders[jose.HeaderKey("enc")].(string)
+	if !contains(validator.contentEncryptionAlgorithms, encryption) {
+		return "", fmt.Errorf("encrypted token enc is not allowed: %s", encryption)
+	}
+	// Compressed tokens are rejected before decryption, as the payload could be a decompression bomb
+	if _, ok := encrypted.Header.ExtraHeaders[jose.HeaderKey("zip")]; ok {
+		return "", fmt.Errorf("encrypted token zip is not supported")
+	}
+	// Only nested JWTs are accepted, as the claims must still be signed by a trusted issuer
+	if contentType, ok := encrypted.Header.ExtraHeaders[jose.HeaderContentType].(string); ok && !strings.EqualFold(contentType, "JWT") {
+		return "", fmt.Errorf("encrypted token cty is not supported: %s", contentType)
+	}
+
+	for _, key := range validator.decryptionKeys {
+		payload, err := encrypted.Decrypt(key)
+		if err != nil {
+			continue
+		}
+		nested := string(payload)
+		if strings.Count(nested, ".") != 2 {
+			return "", fmt.Errorf("encrypted token does not contain a signed JWT")
+		}
+		return nested, nil
+	}
+	return "", fmt.Errorf("failed to decrypt token")
+}
+
+// contains returns true if value is in values.
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -42,7 +42,12 @@ type JSONWebKeySet struct {
 }
 
 func FetchJWKS(url string) (map[string]interface{}, error) {
-	response, err := http.Get(url)
+	return fetchJWKS(http.DefaultClient, url)
+}
+
+// fetchJWKS fetches the JWKS with the given client and returns its keys by key ID.
+func fetchJWKS(client *http.Client, url string) (map[string]interface{}, error) {
+	response, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -59,62 +64,71 @@ func FetchJWKS(url string) (map[string]interface{}, error) {
 		if jwk.Kid == "" {
 			jwk.Kid = JWKThumbprint(jwk)
 		}
-		switch jwk.Kty {
-		case "RSA":
-			{
-				nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
-				if err != nil {
-					break
-				}
-				eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
-				if err != nil {
-					break
-				}
-				keys[jwk.Kid] = &rsa.PublicKey{
-					N: new(big.Int).SetBytes(nBytes),
-					E: int(new(big.Int).SetBytes(eBytes).Uint64()),
-				}
+		key := JWKPublicKey(jwk)
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// JWKPublicKey converts a JSON web key to an RSA or ECDSA public key, or returns nil if it is not a valid key of a supported type.
+func JWKPublicKey(jwk JSONWebKey) interface{} {
+	switch jwk.Kty {
+	case "RSA":
+		{
+			nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				break
+			}
+			eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				break
 			}
-		case "EC":
-			{
-				var curve elliptic.Curve
-				switch jwk.Crv {
-				case "P-256":
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(nBytes),
+				E: int(new(big.Int).SetBytes(eBytes).Uint64()),
+			}
+		}
+	case "EC":
+		{
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				switch jwk.Alg {
+				case "ES256":
 					curve = elliptic.P256()
-				case "P-384":
+				case "ES384":
 					curve = elliptic.P384()
-				case "P-521":
+				case "ES512":
 					curve = elliptic.P521()
 				default:
-					switch jwk.Alg {
-					case "ES256":
-						curve = elliptic.P256()
-					case "ES384":
-						curve = elliptic.P384()
-					case "ES512":
-						curve = elliptic.P521()
-					default:
-						curve = elliptic.P256()
-					}
-				}
-				xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
-				if err != nil {
-					break
-				}
-				yBytes, err := base64.RawURLEncoding.DecodeString(jwk.Y)
-				if err != nil {
-					break
-				}
-				keys[jwk.Kid] = &ecdsa.PublicKey{
-					Curve: curve,
-					X:     new(big.Int).SetBytes(xBytes),
-					Y:     new(big.Int).SetBytes(yBytes),
+					curve = elliptic.P256()
 				}
 			}
+			xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				break
+			}
+			yBytes, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil {
+				break
+			}
+			return &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(xBytes),
+				Y:     new(big.Int).SetBytes(yBytes),
+			}
 		}
 	}
-
-	return keys, nil
+	return nil
 }
 
 // JWKThumbprint creates a JWK thumbprint out of pub
@@ -125,7 +139,11 @@ func JWKThumbprint(jwk JSONWebKey) string {
 	case "RSA":
 		text = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
 	case "EC":
-		text = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, jwk.X, jwk.Y)
+		curve := jwk.Crv
+		if curve == "" {
+			curve = "P-256"
+		}
+		text = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, curve, jwk.X, jwk.Y)
 	}
 	bytes := sha256.Sum256([]byte(text))
 	return base64.RawURLEncoding.EncodeToString(bytes[:])
@@ -3,13 +3,14 @@ package jwt_middleware
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/danwakefield/fnmatch"
@@ -18,49 +19,116 @@ import (
 
 // Config is the configuration for the plugin.
 type Config struct {
-	ValidMethods         []string
-	Issuers              []string
-	Secret               string                 `json:"secret,omitempty"`
-	Require              map[string]interface{} `json:"require,omitempty"`
-	Optional             bool                   `json:"optional,omitempty"`
-	RedirectUnauthorized string                 `json:"redirectUnauthorized,omitempty"`
-	RedirectForbidden    string                 `json:"redirectForbidden,omitempty"`
-	CookieName           string                 `json:"cookieName,omitempty"`
-	HeaderName           string                 `json:"headerName,omitempty"`
-	ParameterName        string                 `json:"parameterName,omitempty"`
-	HeaderMap            map[string]string      `json:"headerMap,omitempty"`
-	ForwardToken         bool                   `json:"forwardToken,omitempty"`
-	Freshness            int64                  `json:"freshness,omitempty"`
-}
-
-// JWTPlugin is a traefik middleware plugin that authorizes access based on JWT tokens.
+	ValidMethods                []string
+	Issuers                     []string
+	Secret                      string                    `json:"secret,omitempty"`
+	Require                     map[string]interface{}    `json:"require,omitempty"`
+	Optional                    bool                      `json:"optional,omitempty"`
+	RedirectUnauthorized        string                    `json:"redirectUnauthorized,omitempty"`
+	RedirectForbidden           string                    `json:"redirectForbidden,omitempty"`
+	CookieName                  string                    `json:"cookieName,omitempty"`
+	HeaderName                  string                    `json:"headerName,omitempty"`
+	ParameterName               string                    `json:"parameterName,omitempty"`
+	TokenSources                []TokenSourceConfig       `json:"tokenSources,omitempty"`
+	HeaderMap                   map[string]string         `json:"headerMap,omitempty"`
+	ForwardToken                bool                      `json:"forwardToken,omitempty"`
+	Freshness                   int64                     `json:"freshness,omitempty"`
+	DecryptionKeys              []string                  `json:"decryptionKeys,omitempty"`
+	KeyManagementAlgorithms     []string                  `json:"keyManagementAlgorithms,omitempty"`
+	ContentEncryptionAlgorithms []string                  `json:"contentEncryptionAlgorithms,omitempty"`
+	TokenTypes                  []string                  `json:"tokenTypes,omitempty"`
+	RejectIDTokens              bool                      `json:"rejectIdTokens,omitempty"`
+	RejectLogoutTokens          bool                      `json:"rejectLogoutTokens,omitempty"`
+	Profile                     string                    `json:"profile,omitempty"`
+	CriticalHeaders             []string                  `json:"criticalHeaders,omitempty"`
+	IntrospectionURL            string                    `json:"introspectionUrl,omitempty"`
+	IntrospectionClientID       string                    `json:"introspectionClientId,omitempty"`
+	IntrospectionClientSecret   string                    `json:"introspectionClientSecret,omitempty"`
+	IntrospectAll               bool                      `json:"introspectAll,omitempty"`
+	IntrospectionCacheTTL       int64                     `json:"introspectionCacheTTL,omitempty"`
+	IntrospectionCacheSize      int                       `json:"introspectionCacheSize,omitempty"`
+	DPoP                        bool                      `json:"dpop,omitempty"`
+	RequireDPoP                 bool                      `json:"requireDpop,omitempty"`
+	DPoPWindow                  int64                     `json:"dpopWindow,omitempty"`
+	CertificateBinding          bool                      `json:"certificateBinding,omitempty"`
+	RequireCertificateBinding   bool                      `json:"requireCertificateBinding,omitempty"`
+	ClientCertificateHeader     string                    `json:"clientCertificateHeader,omitempty"`
+	CacheSize                   int                       `json:"cacheSize,omitempty"`
+	ScopeClaims                 []string                  `json:"scopeClaims,omitempty"`
+	Policy                      string                    `json:"policy,omitempty"`
+	Deny                        map[string]interface{}    `json:"deny,omitempty"`
+	Rules                       []RuleConfig              `json:"rules,omitempty"`
+	RoutePatterns               []string                  `json:"routePatterns,omitempty"`
+	Matching                    map[string]MatchingConfig `json:"matching,omitempty"`
+	Roles                       map[string]RoleConfig     `json:"roles,omitempty"`
+	RoleClaims                  []string                  `json:"roleClaims,omitempty"`
+	PermissionsClaim            string                    `json:"permissionsClaim,omitempty"`
+	ClaimMappings               []ClaimMappingConfig      `json:"claimMappings,omitempty"`
+	ACR                         []string                  `json:"acr,omitempty"`
+	AMR                         []string                  `json:"amr,omitempty"`
+	MaxAge                      int64                     `json:"maxAge,omitempty"`
+	RedirectStepUp              string                    `json:"redirectStepUp,omitempty"`
+	LoginHintClaim              string                    `json:"loginHintClaim,omitempty"`
+	Headers                     map[string]HeaderConfig   `json:"headers,omitempty"`
+	StripHeaders                []string                  `json:"stripHeaders,omitempty"`
+	StripHeaderPrefixes         []string                  `json:"stripHeaderPrefixes,omitempty"`
+	Mint                        *MintConfig               `json:"mint,omitempty"`
+}
+
+// JWTPlugin is a traefik middleware plugin that authorizes access based on JWT tokens. It's an adapter over Validator, acting on its decisions.
 type JWTPlugin struct {
+	*Validator
 	next                 http.Handler
 	name                 string
-	parser               *jwt.Parser
-	secret               interface{}
-	issuers              []string
-	require              map[string][]Requirement
-	lock                 sync.RWMutex
-	keys                 map[string]interface{}
-	issuerKeys           map[string]map[string]interface{}
-	optional             bool
 	redirectUnauthorized *template.Template
 	redirectForbidden    *template.Template
-	cookieName           string
-	headerName           string
-	parameterName        string
+	redirectStepUp       *template.Template
 	headerMap            map[string]string
 	forwardToken         bool
-	freshness            int64
+	headers              map[string]*Header
+	stripHeaders         []string
+	stripHeaderPrefixes  []string
+	minter               *Minter
 }
 
 // TemplateVariables are the per-request variables passed to Go templates for interpolation, such as the require and redirect templates.
 type TemplateVariables struct {
-	URL    string
-	Scheme string
-	Host   string
-	Path   string
+	URL        string
+	Scheme     string
+	Host       string
+	Path       string
+	Method     string
+	Header     http.Header
+	Query      url.Values
+	RemoteAddr string
+	ClientIP   string
+	PathParams map[string]string
+	ACRValues  string // Step-up redirects only, query-escaped
+	MaxAge     int64  // Step-up redirects only
+	LoginHint  string // Step-up redirects only, query-escaped
+
+	now    time.Time   // The validator's clock at the start of the request, for time requirements
+	logger *log.Logger // The validator's logger, for requirements that fail to execute their templates
+}
+
+// time returns the validator's time for the request, or the current time if the variables were not created by a validator.
+func (variables *TemplateVariables) time() time.Time {
+	if variables == nil || variables.now.IsZero() {
+		return time.Now()
+	}
+	return variables.now
+}
+
+// logf logs through the validator's logger, or a logger like the validator's default if the variables were not created by a validator.
+func (variables *TemplateVariables) logf(format string, args ...interface{}) {
+	var logger *log.Logger
+	if variables != nil {
+		logger = variables.logger
+	}
+	if logger == nil {
+		logger = log.New(log.Writer(), "", 0)
+	}
+	logger.Printf(format, args...)
 }
 
 // Requirement is a requirement for a claim.
@@ -70,24 +138,30 @@ type Requirement interface {
 
 // ValueRequirement is a requirement for a claim that is a known value.
 type ValueRequirement struct {
-	value  interface{}
-	nested interface{}
+	value   interface{}
+	nested  interface{}
+	matcher Matcher
 }
 
 // TemplateRequirement is a dynamic requirement for a claim that uses a template that needs interpolating per request.
 type TemplateRequirement struct {
 	template *template.Template
 	nested   interface{}
+	matcher  Matcher
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		ValidMethods: []string{"RS256", "RS512", "ES256", "ES384", "ES512", "HS256"},
-		CookieName:   "Authorization",
-		HeaderName:   "Authorization",
-		ForwardToken: true,
-		Freshness:    3600,
+		ValidMethods:          []string{"RS256", "RS512", "ES256", "ES384", "ES512", "HS256"},
+		CookieName:            "Authorization",
+		HeaderName:            "Authorization",
+		ForwardToken:          true,
+		Freshness:             3600,
+		IntrospectionCacheTTL: 60,
+		DPoPWindow:            300,
+		PermissionsClaim:      "permissions",
+		LoginHintClaim:        "email",
 	}
 }
 
@@ -112,52 +186,62 @@ func SetupSecret(secret string) (interface{}, error) {
 
 // New creates a new JWTPlugin.
 func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	log.SetFlags(0)
+	headers, err := setupHeaders(config.Headers)
+	if err != nil {
+		return nil, err
+	}
 
-	secret, err := SetupSecret(config.Secret)
+	minter, err := setupMinter(config.Mint)
 	if err != nil {
 		return nil, err
 	}
 
-	plugin := JWTPlugin{
+	validator, err := NewValidator(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTPlugin{
+		Validator:            validator,
 		next:                 next,
 		name:                 name,
-		parser:               jwt.NewParser(jwt.WithValidMethods(config.ValidMethods)),
-		secret:               secret,
-		issuers:              canonicalizeDomains(config.Issuers),
-		require:              convertRequire(config.Require),
-		keys:                 make(map[string]interface{}),
-		issuerKeys:           make(map[string]map[string]interface{}),
-		optional:             config.Optional,
 		redirectUnauthorized: createTemplate(config.RedirectUnauthorized),
 		redirectForbidden:    createTemplate(config.RedirectForbidden),
-		cookieName:           config.CookieName,
-		headerName:           config.HeaderName,
-		parameterName:        config.ParameterName,
+		redirectStepUp:       createTemplate(config.RedirectStepUp),
 		headerMap:            config.HeaderMap,
 		forwardToken:         config.ForwardToken,
-		freshness:            config.Freshness,
-	}
-
-	for _, issuer := range plugin.issuers {
-		if strings.Contains(issuer, "*") {
-			continue
-		}
-		err := plugin.fetchKeys(issuer)
-		if err != nil {
-			log.Printf("failed to prefetch keys for %s: %v", issuer, err)
-		}
-	}
-
-	return &plugin, nil
+		headers:              headers,
+		stripHeaders:         setupStripHeaders(config, headers, minter),
+		stripHeaderPrefixes:  setupStripHeaderPrefixes(config.StripHeaderPrefixes),
+		minter:               minter,
+	}, nil
 }
 
 // ServeHTTP is the middleware entry point.
 func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if plugin.minter != nil && plugin.minter.jwksPath != "" && request.URL.Path == plugin.minter.jwksPath {
+		// Serve the keys for minted tokens to backends without requiring a token
+		plugin.minter.serveJWKS(response, request)
+		return
+	}
+
 	variables := plugin.createTemplateVariables(request)
 	status, err := plugin.Validate(request, variables)
 	if err != nil {
-		if plugin.redirectUnauthorized != nil {
+		var stepUp *StepUpError
+		if plugin.redirectStepUp != nil && errors.As(err, &stepUp) {
+			// Interactive clients should be redirected to authenticate again at a higher level.
+			variables.ACRValues = queryEscape(strings.Join(stepUp.ACRValues, " "))
+			variables.MaxAge = stepUp.MaxAge
+			variables.LoginHint = queryEscape(stepUp.LoginHint)
+			url, err := expandTemplate(plugin.redirectStepUp, variables)
+			if err != nil {
+				plugin.logger.Printf("failed to get step-up redirect URL: %v", err)
+				http.Error(response, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(response, request, url, http.StatusFound)
+		} else if plugin.redirectUnauthorized != nil && status != http.StatusBadRequest {
 			// Interactive clients should be redirected to the login page or unauthorized page.
 			var redirectTemplate *template.Template
 			if status == http.StatusUnauthorized || plugin.redirectForbidden == nil {
@@ -167,13 +251,17 @@ func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.R
 			}
 			url, err := expandTemplate(redirectTemplate, variables)
 			if err != nil {
-				log.Printf("failed to get redirect URL: %v", err)
+				plugin.logger.Printf("failed to get redirect URL: %v", err)
 				http.Error(response, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			http.Redirect(response, request, url, http.StatusFound)
 		} else {
-			// Non-interactive (i.e. API) clients should get a 401 or 403 response.
+			// Non-interactive (i.e. API) clients should get a 401 or 403 response, with a challenge if there is one.
+			var challenge Challenge
+			if errors.As(err, &challenge) {
+				response.Header().Set("WWW-Authenticate", challenge.Challenge())
+			}
 			http.Error(response, err.Error(), status)
 		}
 		return
@@ -181,48 +269,105 @@ func (plugin *JWTPlugin) ServeHTTP(response http.ResponseWriter, request *http.R
 	plugin.next.ServeHTTP(response, request)
 }
 
-// Validate validates the request and returns the HTTP status code or an error if the request is not valid. It also sets any headers that should be forwarded to the backend.
+// Validate validates the request and returns the HTTP status code or an error if the request is not valid. If it is valid, it removes the token unless
+// forwardToken is set, sets any headers that should be forwarded to the backend and attaches the ValidationResult to the request context for Go handlers
+// (see ResultFromContext).
 func (plugin *JWTPlugin) Validate(request *http.Request, variables *TemplateVariables) (int, error) {
-	token := plugin.extractToken(request)
-	if token == "" {
-		// No token provided
-		if !plugin.optional {
-			return http.StatusUnauthorized, fmt.Errorf("no token provided")
-		}
-	} else {
-		// Token provided
-		token, err := plugin.parser.Parse(token, plugin.GetKey)
+	decision := plugin.decide(request, variables)
+
+	// Remove any client-supplied values of the headers we set, whether or not there's a token
+	plugin.removeHeaders(request)
+	if !decision.Allowed() {
+		return decision.Status, decision.Err
+	}
+	if decision.Result == nil {
+		// No token, but it's optional
+		return http.StatusOK, nil
+	}
+	if !plugin.forwardToken {
+		decision.extractor.Remove(request)
+	}
+
+	// Map any claims to headers
+	plugin.setHeaders(request, decision.Result.Claims, decision.Result.Header)
+
+	// Forward an internal token in place of the external one
+	if plugin.minter != nil {
+		err := plugin.minter.mint(request, decision.Rule, decision.Result.Claims, plugin.now())
 		if err != nil {
-			return http.StatusUnauthorized, err
+			return http.StatusInternalServerError, err
 		}
+	}
 
-		claims := token.Claims.(jwt.MapClaims)
-
-		// Validate claims
-		for claim, requirements := range plugin.require {
-			result := plugin.ValidateClaim(claim, claims, requirements, variables)
-			if !result {
-				err := fmt.Errorf("claim is not valid: %s", claim)
-				// If the token is older than out freshness window, we allow that reauthorization might fix it
-				iat, ok := claims["iat"]
-				if ok && plugin.freshness != 0 && time.Now().Unix()-int64(iat.(float64)) > plugin.freshness {
-					return http.StatusUnauthorized, err
-				} else {
-					return http.StatusForbidden, err
-				}
-			}
+	// Attach the result to the request in place, so that it's passed on to the next handler
+	*request = *request.WithContext(contextWithResult(request.Context(), decision.Result))
+	return http.StatusOK, nil
+}
+
+// parseToken decrypts the token if necessary, then verifies its signature and type and returns its claims and header. Verified tokens are cached if the cache is enabled.
+func (validator *Validator) parseToken(token string) (jwt.MapClaims, map[string]interface{}, error) {
+	var hash string
+	if validator.cache != nil {
+		hash = hashToken(token)
+		if cached, ok := validator.cache.get(hash, validator.now()); ok {
+			return cached.claims, cached.header, nil
 		}
+	}
 
-		// Map any require claims to headers
-		for header, claim := range plugin.headerMap {
-			value, ok := claims[claim]
-			if ok {
-				request.Header.Add(header, fmt.Sprint(value))
-			}
+	if isEncrypted(token) {
+		decrypted, err := validator.decryptToken(token)
+		if err != nil {
+			return nil, nil, err
 		}
+		token = decrypted
 	}
 
-	return http.StatusOK, nil
+	var source keySource
+	parsed, err := validator.parser.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		var key interface{}
+		var err error
+		key, source, err = validator.getKey(token)
+		return key, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = validator.validateTokenType(parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+	if validator.cache != nil {
+		validator.cacheToken(hash, parsed, claims, source)
+	}
+	return claims, parsed.Header, nil
+}
+
+// cacheToken adds a verified token to the cache along with the identity of the key that verified it, so that it can be invalidated if that key is dropped.
+func (validator *Validator) cacheToken(hash string, parsed *jwt.Token, claims jwt.MapClaims, source keySource) {
+	if source == keySourceProvider {
+		// A provider may stop returning the key without us knowing, so tokens it verified must be verified again every time
+		return
+	}
+
+	entry := cachedToken{hash: hash, claims: claims, header: parsed.Header}
+	if expires, err := claims.GetExpirationTime(); err == nil && expires != nil {
+		entry.expires = expires.Time
+	}
+
+	// Hold the read lock so that the key can't be dropped between checking it and caching the token
+	validator.lock.RLock()
+	defer validator.lock.RUnlock()
+	if kid, ok := parsed.Header["kid"].(string); ok {
+		if _, ok := validator.keys[kid]; !ok {
+			// Verified by the fixed secret, or by a key that has since been dropped, so we can't safely cache it
+			return
+		}
+		entry.keyID = kid
+	}
+	validator.cache.add(&entry)
 }
 
 // Validate checks value against the requirement, calling ourself recursively for object and array values.
@@ -247,7 +392,7 @@ func (requirement ValueRequirement) Validate(value interface{}, variables *Templ
 		if !ok {
 			return false
 		}
-		return fnmatch.Match(value, required, 0) || value == fmt.Sprintf("*.%s", required)
+		return requirement.matcher.Match(value, required)
 	}
 
 	return reflect.DeepEqual(value, requirement.value)
@@ -276,10 +421,17 @@ func (requirement ValueRequirement) ValidateNested(value interface{}) bool {
 		supplied = []interface{}{value}
 	}
 
-	// If any of the values match any of the nested requirement, the claim is valid.
+	// If any of the values match any of the nested requirement, the claim is valid. Strings are matched with the claim's Matcher if it has
+	// a matching configuration, and exactly otherwise, so that wildcards in nested claims are only granted when explicitly configured.
 	for _, required := range required {
 		for _, supplied := range supplied {
-			if reflect.DeepEqual(required, supplied) {
+			requiredString, ok := required.(string)
+			suppliedString, isString := supplied.(string)
+			if ok && isString && requirement.matcher.configured() {
+				if requirement.matcher.Match(suppliedString, requiredString) {
+					return true
+				}
+			} else if reflect.DeepEqual(required, supplied) {
 				return true
 			}
 		}
@@ -292,56 +444,90 @@ func (requirement TemplateRequirement) Validate(value interface{}, variables *Te
 	var buffer bytes.Buffer
 	err := requirement.template.Execute(&buffer, variables)
 	if err != nil {
-		log.Printf("Error executing template: %s", err)
+		variables.logf("Error executing template: %s", err)
 		return false
 	}
-	return ValueRequirement{value: buffer.String(), nested: requirement.nested}.Validate(value, variables)
+	return ValueRequirement{value: buffer.String(), nested: requirement.nested, matcher: requirement.matcher}.Validate(value, variables)
 }
 
-// convertRequire converts the require configuration to a map of requirements.
-func convertRequire(require map[string]interface{}) map[string][]Requirement {
+// convertRequire converts the require configuration to a map of requirements. Requirements for any of the scopeClaims are converted to ScopeRequirements,
+// and values are matched using the claim's Matcher, if any.
+func convertRequire(require map[string]interface{}, scopeClaims []string, matchers map[string]Matcher) (map[string][]Requirement, error) {
 	converted := make(map[string][]Requirement, len(require))
 	for key, value := range require {
+		matcher := matchers[key]
+		if contains(scopeClaims, key) {
+			requirements, err := convertScopeRequire(value)
+			if err != nil {
+				return nil, fmt.Errorf("claim %s: %w", key, err)
+			}
+			if requirements != nil {
+				converted[key] = requirements
+				continue
+			}
+		}
+		var requirements []Requirement
 		switch value := value.(type) {
 		case []interface{}:
-			requirements := make([]Requirement, len(value))
+			requirements = make([]Requirement, len(value))
 			for index, value := range value {
-				requirements[index] = createRequirement(value, nil)
+				requirement, err := createRequirement(value, nil, matcher)
+				if err != nil {
+					return nil, fmt.Errorf("claim %s: %w", key, err)
+				}
+				requirements[index] = requirement
 			}
-			converted[key] = requirements
 		case map[string]interface{}:
-			requirements := make([]Requirement, len(value))
-			index := 0
-			for key, value := range value {
-				requirements[index] = createRequirement(key, value)
-				index++
+			if isOperatorMap(value) {
+				requirement, err := createOperatorRequirement(value)
+				if err != nil {
+					return nil, fmt.Errorf("claim %s: %w", key, err)
+				}
+				requirements = []Requirement{requirement}
+				break
+			}
+			requirements = make([]Requirement, 0, len(value))
+			for required, nested := range value {
+				requirement, err := createRequirement(required, nested, matcher)
+				if err != nil {
+					return nil, fmt.Errorf("claim %s: %w", key, err)
+				}
+				requirements = append(requirements, requirement)
 			}
-			converted[key] = requirements
 		default:
-			converted[key] = []Requirement{createRequirement(value, nil)}
+			requirement, err := createRequirement(value, nil, matcher)
+			if err != nil {
+				return nil, fmt.Errorf("claim %s: %w", key, err)
+			}
+			requirements = []Requirement{requirement}
 		}
-
+		converted[key] = requirements
 	}
-	return converted
+	return converted, nil
 }
 
 // createRequirement creates a Requirement of the correct type from the given value (and any nested value).
-func createRequirement(value interface{}, nested interface{}) Requirement {
+func createRequirement(value interface{}, nested interface{}, matcher Matcher) (Requirement, error) {
 	switch value := value.(type) {
 	case string:
 		if strings.Contains(value, "{{") && strings.Contains(value, "}}") {
-			return TemplateRequirement{
-				template: template.Must(template.New("template").Parse(value)),
-				nested:   nested,
+			parsed, err := template.New("template").Parse(value)
+			if err != nil {
+				return nil, err
 			}
+			return TemplateRequirement{template: parsed, nested: nested, matcher: matcher}, nil
+		}
+	case map[string]interface{}:
+		if isOperatorMap(value) {
+			return createOperatorRequirement(value)
 		}
 	}
-	return ValueRequirement{value: value, nested: nested}
+	return ValueRequirement{value: value, nested: nested, matcher: matcher}, nil
 }
 
-// ValidateClaim
-func (plugin *JWTPlugin) ValidateClaim(claim string, claims jwt.MapClaims, requirements []Requirement, variables *TemplateVariables) bool {
-	value, ok := claims[claim]
+// ValidateClaim returns true if the claim, which may be a nested claim path, satisfies any of the requirements.
+func (validator *Validator) ValidateClaim(claim string, claims jwt.MapClaims, requirements []Requirement, variables *TemplateVariables) bool {
+	value, ok := lookupClaim(claims, claim)
 	if ok {
 		for _, requirement := range requirements {
 			if requirement.Validate(value, variables) {
@@ -352,35 +538,56 @@ func (plugin *JWTPlugin) ValidateClaim(claim string, claims jwt.MapClaims, requi
 	return false
 }
 
-// GetKey gets the key for the given key ID from the plugin's key cache. If the key isn't present and the iss is valid according to the plugin's configuration, all keys for the iss are fetched and the key is looked up again.
-func (plugin *JWTPlugin) GetKey(token *jwt.Token) (interface{}, error) {
+// keySource identifies where the key that verified a token came from.
+type keySource int
+
+const (
+	keySourceJWKS     keySource = iota // Fetched from an issuer's JWKS
+	keySourceProvider                  // Returned by a KeyProvider
+	keySourceSecret                    // The fixed secret
+)
+
+// GetKey gets the key for the given key ID from the validator's key cache. If the key isn't present and the iss is valid according to the plugin's configuration, all keys for the iss are fetched and the key is looked up again.
+func (validator *Validator) GetKey(token *jwt.Token) (interface{}, error) {
+	key, _, err := validator.getKey(token)
+	return key, err
+}
+
+// getKey gets the key for the token as for GetKey, and reports where it came from.
+func (validator *Validator) getKey(token *jwt.Token) (interface{}, keySource, error) {
+	// Reject tokens with critical extensions we don't understand before doing any work to find a key
+	err := validator.validateCritical(token.Header)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	kid, ok := token.Header["kid"]
 	if ok {
 		for fetched := false; ; fetched = true {
-			plugin.lock.RLock()
-			key, ok := plugin.keys[kid.(string)]
-			plugin.lock.RUnlock()
+			validator.lock.RLock()
+			key, ok := validator.keys[kid.(string)]
+			validator.lock.RUnlock()
 			if ok {
-				return key, nil
+				return key, keySourceJWKS, nil
 			}
 
 			if fetched {
-				log.Printf("key %s: fetched and no match", kid)
+				validator.logger.Printf("key %s: fetched and no match", kid)
 				break
 			}
 
 			issuer, ok := token.Claims.(jwt.MapClaims)["iss"].(string)
 			if ok {
 				issuer = canonicalizeDomain(issuer)
-				if plugin.IsValidIssuer(issuer) {
-					plugin.lock.Lock()
-					if _, ok := plugin.keys[kid.(string)]; !ok {
-						err := plugin.fetchKeys(issuer) // issue has trailing slash
+				if validator.IsValidIssuer(issuer) {
+					validator.lock.Lock()
+					if _, ok := validator.keys[kid.(string)]; !ok {
+						err := validator.fetchKeys(issuer) // issue has trailing slash
 						if err != nil {
-							log.Printf("failed to fetch keys for %s: %v", issuer, err)
+							validator.logger.Printf("failed to fetch keys for %s: %v", issuer, err)
 						}
 					}
-					plugin.lock.Unlock()
+					validator.lock.Unlock()
 				}
 			} else {
 				break
@@ -388,17 +595,70 @@ func (plugin *JWTPlugin) GetKey(token *jwt.Token) (interface{}, error) {
 		}
 	}
 
+	// Then any key providers
+	for _, provider := range validator.keyProviders {
+		key, err := provider.Key(token)
+		if err != nil {
+			return nil, 0, err
+		}
+		if key != nil {
+			return key, keySourceProvider, nil
+		}
+	}
+
 	// We fall back to any fixed secret
-	if plugin.secret == nil {
-		return nil, fmt.Errorf("no secret configured")
+	if validator.secret == nil {
+		return nil, 0, fmt.Errorf("no secret configured")
+	}
+
+	return validator.secret, keySourceSecret, nil
+}
+
+// registeredHeaders are the JWS header parameters defined by RFC 7515, which may not appear in crit.
+var registeredHeaders = []string{"alg", "jku", "jwk", "kid", "x5u", "x5c", "x5t", "x5t#S256", "typ", "cty", "crit"}
+
+// validateCritical checks that every header parameter listed in crit is present and is one the plugin is configured to understand, as required by RFC 7515.
+func (validator *Validator) validateCritical(header map[string]interface{}) error {
+	value, ok := header["crit"]
+	if !ok {
+		return nil
+	}
+	critical, ok := value.([]interface{})
+	if !ok || len(critical) == 0 {
+		return fmt.Errorf("crit header must be a non-empty list")
 	}
+	for _, name := range critical {
+		name, ok := name.(string)
+		if !ok || name == "" {
+			return fmt.Errorf("crit header must contain only header names")
+		}
+		if contains(registeredHeaders, name) {
+			return fmt.Errorf("crit header must not list registered header: %s", name)
+		}
+		if !contains(validator.criticalHeaders, name) {
+			return fmt.Errorf("unsupported critical header: %s", name)
+		}
+		if _, ok := header[name]; !ok {
+			return fmt.Errorf("critical header is missing: %s", name)
+		}
+	}
+	return nil
+}
 
-	return plugin.secret, nil
+// keyIssuer returns the issuer from which the key identified by the token header's kid was fetched, or an empty string if there is none.
+func (validator *Validator) keyIssuer(header map[string]interface{}) string {
+	kid, ok := header["kid"].(string)
+	if !ok {
+		return ""
+	}
+	validator.lock.RLock()
+	defer validator.lock.RUnlock()
+	return validator.keyIssuers[kid]
 }
 
 // IsValidIssuer returns true if the issuer is allowed by the Issers configuration.
-func (plugin *JWTPlugin) IsValidIssuer(issuer string) bool {
-	for _, allowed := range plugin.issuers {
+func (validator *Validator) IsValidIssuer(issuer string) bool {
+	for _, allowed := range validator.issuers {
 		if fnmatch.Match(allowed, issuer, 0) {
 			return true
 		}
@@ -407,30 +667,35 @@ func (plugin *JWTPlugin) IsValidIssuer(issuer string) bool {
 }
 
 // fetchKeys fetches the keys from well-known jwks endpoint for the given issuer and adds them to the key map.
-func (plugin *JWTPlugin) fetchKeys(issuer string) error {
+func (validator *Validator) fetchKeys(issuer string) error {
 	configURL := issuer + ".well-known/openid-configuration" // issuer has trailing slash
-	config, err := FetchOpenIDConfiguration(configURL)
+	config, err := fetchOpenIDConfiguration(validator.client, configURL)
 	if err != nil {
 		return err
 	}
-	log.Printf("fetched openid-configuration from url:%s", configURL)
-	jwks, err := FetchJWKS(config.JWKSURI)
+	validator.logger.Printf("fetched openid-configuration from url:%s", configURL)
+	jwks, err := fetchJWKS(validator.client, config.JWKSURI)
 	if err != nil {
 		return err
 	}
 	for keyID, key := range jwks {
-		log.Printf("fetched key:%s from url:%s", keyID, config.JWKSURI)
-		plugin.keys[keyID] = key
+		validator.logger.Printf("fetched key:%s from url:%s", keyID, config.JWKSURI)
+		validator.keys[keyID] = key
+		validator.keyIssuers[keyID] = issuer
 	}
 
-	previous := plugin.issuerKeys[config.JWKSURI]
+	previous := validator.issuerKeys[config.JWKSURI]
 	for keyID := range previous {
 		if _, ok := jwks[keyID]; !ok {
-			log.Printf("key:%s dropped by url:%s", keyID, config.JWKSURI)
-			delete(plugin.keys, keyID)
+			validator.logger.Printf("key:%s dropped by url:%s", keyID, config.JWKSURI)
+			delete(validator.keys, keyID)
+			delete(validator.keyIssuers, keyID)
+			if validator.cache != nil {
+				validator.cache.removeKey(keyID)
+			}
 		}
 	}
-	plugin.issuerKeys[config.JWKSURI] = jwks
+	validator.issuerKeys[config.JWKSURI] = jwks
 
 	return nil
 }
@@ -451,6 +716,14 @@ func canonicalizeDomains(domains []string) []string {
 	return domains
 }
 
+// withDefault returns values, or defaults if no values are given.
+func withDefault(values []string, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
+
 // createTemplate creates a template from the given redirect string, or nil if no specified.
 func createTemplate(text string) *template.Template {
 	if text == "" {
@@ -460,7 +733,7 @@ func createTemplate(text string) *template.Template {
 }
 
 // createTemplateVariables creates a template data object for the given request.
-func (plugin *JWTPlugin) createTemplateVariables(request *http.Request) *TemplateVariables {
+func (validator *Validator) createTemplateVariables(request *http.Request) *TemplateVariables {
 	var variables TemplateVariables
 
 	if request.URL.Host != "" {
@@ -479,6 +752,15 @@ func (plugin *JWTPlugin) createTemplateVariables(request *http.Request) *Templat
 		variables.URL = fmt.Sprintf("%s://%s%s", variables.Scheme, variables.Host, variables.Path)
 	}
 
+	variables.Method = request.Method
+	variables.Header = request.Header
+	variables.Query = request.URL.Query()
+	variables.RemoteAddr = request.RemoteAddr
+	variables.ClientIP = clientIP(request)
+	variables.PathParams = validator.matchRoute(request.URL)
+	variables.now = validator.now()
+	variables.logger = validator.logger
+
 	return &variables
 }
 
@@ -492,70 +774,3 @@ func expandTemplate(redirectTemplate *template.Template, variables *TemplateVari
 	return buffer.String(), nil
 
 }
-
-// extractToken extracts the token from the request using the first configured method that finds one, in order of cookie, header, query parameter.
-func (plugin *JWTPlugin) extractToken(request *http.Request) string {
-	token := ""
-	if plugin.cookieName != "" {
-		token = plugin.extractTokenFromCookie(request)
-	}
-	if len(token) == 0 && plugin.headerName != "" {
-		token = plugin.extractTokenFromHeader(request)
-	}
-	if len(token) == 0 && plugin.parameterName != "" {
-		token = plugin.extractTokenFromQuery(request)
-	}
-	return token
-}
-
-// extractTokenFromCookie extracts the token from the cookie. If the token is found, it is removed from the cookies unless forwardToken is true.
-func (plugin *JWTPlugin) extractTokenFromCookie(request *http.Request) string {
-	cookie, error := request.Cookie(plugin.cookieName)
-	if error != nil {
-		return ""
-	}
-	if !plugin.forwardToken {
-		cookies := request.Cookies()
-		request.Header.Del("Cookie")
-		for _, cookie := range cookies {
-			if cookie.Name != plugin.cookieName {
-				request.AddCookie(cookie)
-			}
-		}
-	}
-	return cookie.Value
-}
-
-// extractTokenFromHeader extracts the token from the header. If the token is found, it is removed from the header unless forwardToken is true.
-func (plugin *JWTPlugin) extractTokenFromHeader(request *http.Request) string {
-	header, ok := request.Header[plugin.headerName]
-	if !ok {
-		return ""
-	}
-
-	token := header[0]
-
-	if !plugin.forwardToken {
-		request.Header.Del(plugin.headerName)
-	}
-
-	if strings.HasPrefix(token, "Bearer ") {
-		return token[7:]
-	}
-	return token
-}
-
-// extractTokenFromQuery extracts the token from the query parameter. If the token is found, it is removed from the query unless forwardToken is true.
-func (plugin *JWTPlugin) extractTokenFromQuery(request *http.Request) string {
-	if request.URL.Query().Has(plugin.parameterName) {
-		token := request.URL.Query().Get(plugin.parameterName)
-		if !plugin.forwardToken {
-			query := request.URL.Query()
-			query.Del(plugin.parameterName)
-			request.URL.RawQuery = query.Encode()
-			request.RequestURI = request.URL.RequestURI()
-		}
-		return token
-	}
-	return ""
-}
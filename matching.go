@@ -0,0 +1,101 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/danwakefield/fnmatch"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Wildcard modes for matching string claim values against required values.
+const (
+	WildcardsExact       = "exact"       // No wildcards: the claim must equal the requirement
+	WildcardsClaim       = "claim"       // Wildcards in the claim are granted, e.g. a claim of * satisfies any requirement (the default)
+	WildcardsRequirement = "requirement" // Wildcards in the requirement match any claim, e.g. a requirement of *@example.com
+	WildcardsBoth        = "both"        // Wildcards on either side match
+)
+
+// Unicode normalization forms for matching string claim values against required values.
+const (
+	NormalizeNFC  = "nfc"  // Canonical composition, e.g. e followed by a combining acute accent becomes é
+	NormalizeNFD  = "nfd"  // Canonical decomposition, e.g. é becomes e followed by a combining acute accent
+	NormalizeNFKC = "nfkc" // Compatibility composition, which also folds e.g. fullwidth letters and ligatures to their plain equivalents
+	NormalizeNFKD = "nfkd" // Compatibility decomposition
+)
+
+// normalizationForms are the supported normalization forms by name.
+var normalizationForms = map[string]norm.Form{
+	NormalizeNFC:  norm.NFC,
+	NormalizeNFD:  norm.NFD,
+	NormalizeNFKC: norm.NFKC,
+	NormalizeNFKD: norm.NFKD,
+}
+
+// MatchingConfig is the configuration for how the values of a claim are matched against its requirements.
+type MatchingConfig struct {
+	Wildcards  string `json:"wildcards,omitempty"`
+	IgnoreCase bool   `json:"ignoreCase,omitempty"`
+	Normalize  string `json:"normalize,omitempty"`
+}
+
+// Matcher matches string claim values against required values. The zero value matches with wildcards in the claim, case-sensitively
+// and without normalization.
+type Matcher struct {
+	wildcards  string
+	ignoreCase bool
+	normalize  string
+}
+
+// createMatchers creates the Matchers for the configured claims.
+func createMatchers(config map[string]MatchingConfig) (map[string]Matcher, error) {
+	matchers := make(map[string]Matcher, len(config))
+	for claim, matching := range config {
+		wildcards := strings.ToLower(matching.Wildcards)
+		switch wildcards {
+		case "":
+			wildcards = WildcardsClaim
+		case WildcardsExact, WildcardsClaim, WildcardsRequirement, WildcardsBoth:
+		default:
+			return nil, fmt.Errorf("claim %s: unknown wildcards mode: %s", claim, matching.Wildcards)
+		}
+		normalize := strings.ToLower(matching.Normalize)
+		if _, ok := normalizationForms[normalize]; normalize != "" && !ok {
+			return nil, fmt.Errorf("claim %s: unknown normalization: %s", claim, matching.Normalize)
+		}
+		matchers[claim] = Matcher{wildcards: wildcards, ignoreCase: matching.IgnoreCase, normalize: normalize}
+	}
+	return matchers, nil
+}
+
+// configured returns true if the matcher was created from a matching configuration, rather than being the zero value.
+func (matcher Matcher) configured() bool {
+	return matcher.wildcards != ""
+}
+
+// Match returns true if the claim value matches the required value.
+func (matcher Matcher) Match(value string, required string) bool {
+	if form, ok := normalizationForms[matcher.normalize]; ok {
+		value = form.String(value)
+		required = form.String(required)
+	}
+	if matcher.ignoreCase {
+		value = strings.ToLower(value)
+		required = strings.ToLower(required)
+	}
+	switch matcher.wildcards {
+	case WildcardsExact:
+		return value == required
+	case WildcardsRequirement:
+		return fnmatch.Match(required, value, 0)
+	case WildcardsBoth:
+		return matchClaimWildcards(value, required) || fnmatch.Match(required, value, 0)
+	default:
+		return matchClaimWildcards(value, required)
+	}
+}
+
+// matchClaimWildcards returns true if the claim value, as a pattern, matches the required value. A claim of *.example.com also matches example.com.
+func matchClaimWildcards(value string, required string) bool {
+	return fnmatch.Match(value, required, 0) || value == fmt.Sprintf("*.%s", required)
+}
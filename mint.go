@@ -0,0 +1,205 @@
+package jwt_middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MintConfig is the configuration for minting an internal JWT to forward to the backend after successful validation.
+type MintConfig struct {
+	Key       string            `json:"key,omitempty"`
+	Algorithm string            `json:"algorithm,omitempty"`
+	KeyID     string            `json:"keyId,omitempty"`
+	Issuer    string            `json:"issuer,omitempty"`
+	Audience  string            `json:"audience,omitempty"`
+	Lifetime  int64             `json:"lifetime,omitempty"`
+	Claims    map[string]string `json:"claims,omitempty"`
+	Header    string            `json:"header,omitempty"`
+	JWKSPath  string            `json:"jwksPath,omitempty"`
+}
+
+// Minter mints internal JWTs and serves the JWKS with which backends can verify them.
+type Minter struct {
+	key      interface{}
+	method   jwt.SigningMethod
+	keyID    string
+	issuer   string
+	audience string
+	lifetime time.Duration
+	claims   map[string]string
+	header   string
+	jwksPath string
+	jwks     []byte
+}
+
+// DefaultMintLifetime is the lifetime in seconds of minted tokens when none is configured.
+const DefaultMintLifetime = 300
+
+// setupMinter parses the minting key and creates the Minter, or returns nil if minting is not configured.
+func setupMinter(config *MintConfig) (*Minter, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	block, _ := pem.Decode([]byte(config.Key))
+	if block == nil {
+		return nil, fmt.Errorf("invalid mint key: not PEM encoded")
+	}
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mint key: %w", err)
+	}
+
+	jwk, err := mintJWK(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mint key: %w", err)
+	}
+	if config.Algorithm != "" {
+		jwk.Alg = config.Algorithm
+	}
+	method := jwt.GetSigningMethod(jwk.Alg)
+	if method == nil {
+		return nil, fmt.Errorf("unknown mint algorithm: %s", jwk.Alg)
+	}
+	// Check that the algorithm is compatible with the key now rather than failing every request
+	_, err = jwt.New(method).SignedString(key)
+	if err != nil {
+		return nil, fmt.Errorf("mint algorithm %s: %w", jwk.Alg, err)
+	}
+
+	jwk.Kid = config.KeyID
+	if jwk.Kid == "" {
+		jwk.Kid = JWKThumbprint(jwk)
+	}
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []interface{}{publicJWK(jwk)}})
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := config.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultMintLifetime
+	}
+	claims := config.Claims
+	if len(claims) == 0 {
+		claims = map[string]string{"sub": "sub"}
+	}
+	header := config.Header
+	if header == "" {
+		header = "Authorization"
+	}
+
+	return &Minter{
+		key:      key,
+		method:   method,
+		keyID:    jwk.Kid,
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		lifetime: time.Duration(lifetime) * time.Second,
+		claims:   claims,
+		header:   http.CanonicalHeaderKey(header),
+		jwksPath: config.JWKSPath,
+		jwks:     jwks,
+	}, nil
+}
+
+// mintJWK returns the public JWK for the private key, with the default algorithm for the key type and curve.
+func mintJWK(key interface{}) (JSONWebKey, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PrivateKey:
+		curve := key.Curve.Params()
+		size := (curve.BitSize + 7) / 8
+		algorithms := map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+		algorithm, ok := algorithms[curve.Name]
+		if !ok {
+			return JSONWebKey{}, fmt.Errorf("unsupported curve %s", curve.Name)
+		}
+		return JSONWebKey{
+			Kty: "EC",
+			Alg: algorithm,
+			Crv: curve.Name,
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	}
+	return JSONWebKey{}, fmt.Errorf("unsupported key type %T", key)
+}
+
+// publicJWK returns the members of the JWK that apply to its key type, for serving in the JWKS.
+func publicJWK(jwk JSONWebKey) map[string]string {
+	members := map[string]string{"kty": jwk.Kty, "kid": jwk.Kid, "alg": jwk.Alg, "use": "sig"}
+	if jwk.Kty == "RSA" {
+		members["n"] = jwk.N
+		members["e"] = jwk.E
+	} else {
+		members["crv"] = jwk.Crv
+		members["x"] = jwk.X
+		members["y"] = jwk.Y
+	}
+	return members
+}
+
+// mint signs an internal JWT with the configured claims, issuer and audience (or the rule's audience), issued at now, and sets it in the configured header.
+func (minter *Minter) mint(request *http.Request, rule *Rule, claims map[string]interface{}, now time.Time) error {
+	minted := jwt.MapClaims{}
+	for claim, source := range minter.claims {
+		if value, ok := lookupClaim(claims, source); ok {
+			minted[claim] = value
+		}
+	}
+
+	// Registered claims are set last so that they can't be overridden by mapped claims
+	minted["iat"] = now.Unix()
+	minted["exp"] = now.Add(minter.lifetime).Unix()
+	if minter.issuer != "" {
+		minted["iss"] = minter.issuer
+	}
+	audience := minter.audience
+	if rule.mintAudience != "" {
+		audience = rule.mintAudience
+	}
+	if audience != "" {
+		minted["aud"] = audience
+	}
+
+	token := jwt.NewWithClaims(minter.method, minted)
+	token.Header["kid"] = minter.keyID
+	signed, err := token.SignedString(minter.key)
+	if err != nil {
+		return fmt.Errorf("failed to mint token: %w", err)
+	}
+
+	if minter.header == "Authorization" {
+		signed = "Bearer " + signed
+	}
+	request.Header.Set(minter.header, signed)
+	return nil
+}
+
+// serveJWKS serves the JWKS containing the public key of minted tokens.
+func (minter *Minter) serveJWKS(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		response.Header().Set("Allow", "GET, HEAD")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "max-age=300")
+	_, _ = response.Write(minter.jwks)
+}
@@ -0,0 +1,87 @@
+package jwt_middleware
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// validateCertificateBinding checks that the token's cnf.x5t#S256 matches the thumbprint of the client certificate, as per RFC 8705.
+func (validator *Validator) validateCertificateBinding(request *http.Request, claims jwt.MapClaims) error {
+	if !validator.certificateBinding {
+		return nil
+	}
+
+	confirmation, _ := claims["cnf"].(map[string]interface{})
+	thumbprint, bound := confirmation["x5t#S256"].(string)
+	if !bound {
+		if validator.requireCertificateBinding {
+			return fmt.Errorf("token is not bound to a client certificate")
+		}
+		return nil
+	}
+
+	certificate, err := validator.clientCertificate(request)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(certificate.Raw)
+	if thumbprint != base64.RawURLEncoding.EncodeToString(hash[:]) {
+		return fmt.Errorf("token is not bound to the client certificate")
+	}
+	return nil
+}
+
+// clientCertificate returns the client certificate from the configured forwarded header, or from the TLS connection if no header is configured.
+func (validator *Validator) clientCertificate(request *http.Request) (*x509.Certificate, error) {
+	if validator.clientCertificateHeader == "" {
+		if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+			return nil, fmt.Errorf("no client certificate provided")
+		}
+		return request.TLS.PeerCertificates[0], nil
+	}
+
+	value := request.Header.Get(validator.clientCertificateHeader)
+	if value == "" {
+		return nil, fmt.Errorf("no client certificate provided")
+	}
+	return parseForwardedCertificate(value)
+}
+
+// parseForwardedCertificate parses the first certificate from a forwarded header value, either URL-encoded PEM (e.g. nginx) or Traefik's comma-separated, URL-encoded base64 DER without PEM delimiters.
+func parseForwardedCertificate(value string) (*x509.Certificate, error) {
+	// PathUnescape rather than QueryUnescape as base64 may contain + that must not become a space
+	value, err := url.PathUnescape(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	var der []byte
+	if strings.Contains(value, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil {
+			return nil, fmt.Errorf("invalid client certificate: not PEM encoded")
+		}
+		der = block.Bytes
+	} else {
+		first, _, _ := strings.Cut(value, ",")
+		first = strings.Join(strings.Fields(first), "")
+		der, err = base64.StdEncoding.DecodeString(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	return certificate, nil
+}
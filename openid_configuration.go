@@ -11,7 +11,12 @@ type OpenIDConfiguration struct {
 }
 
 func FetchOpenIDConfiguration(url string) (*OpenIDConfiguration, error) {
-	response, err := http.Get(url)
+	return fetchOpenIDConfiguration(http.DefaultClient, url)
+}
+
+// fetchOpenIDConfiguration fetches the OpenID configuration with the given client.
+func fetchOpenIDConfiguration(client *http.Client, url string) (*OpenIDConfiguration, error) {
+	response, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
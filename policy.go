@@ -0,0 +1,492 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Policy is a compiled boolean expression over claims and template variables, e.g. `"admin" in roles || ("editor" in roles && tenant == .Host)`.
+type Policy struct {
+	text string
+	root expression
+}
+
+// expression is a node of a compiled policy.
+type expression interface {
+	evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{}
+}
+
+// CompilePolicy parses the policy text, returning an error describing the position of any syntax error.
+func CompilePolicy(text string) (*Policy, error) {
+	tokens, err := lexPolicy(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	parser := policyParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err == nil && parser.peek().kind != tokenEnd {
+		err = fmt.Errorf("unexpected %s at position %d", parser.peek(), parser.peek().position)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return &Policy{text: text, root: root}, nil
+}
+
+// Evaluate returns true if the policy is satisfied by the claims and variables.
+func (policy *Policy) Evaluate(claims map[string]interface{}, variables *TemplateVariables) bool {
+	return truthy(policy.root.evaluate(claims, variables))
+}
+
+// String returns the policy text.
+func (policy *Policy) String() string {
+	return policy.text
+}
+
+// tokenKind is the kind of a policyToken.
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenOperator
+	tokenString
+	tokenNumber
+	tokenIdentifier
+	tokenClaim
+	tokenVariable
+)
+
+// policyToken is a lexical token of a policy, with its position for error reporting.
+type policyToken struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+// String describes the token for error messages.
+func (token policyToken) String() string {
+	if token.kind == tokenEnd {
+		return "end of policy"
+	}
+	return fmt.Sprintf("%q", token.text)
+}
+
+// policyOperators are the operators and punctuation of the policy language, with longer operators first so that they match in preference.
+var policyOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+// lexPolicy splits the policy text into tokens.
+func lexPolicy(text string) ([]policyToken, error) {
+	var tokens []policyToken
+	position := 0
+	for position < len(text) {
+		character := text[position]
+		switch {
+		case character == ' ' || character == '\t' || character == '\n' || character == '\r':
+			position++
+		case character == '"' || character == '\'':
+			end := position + 1
+			var value strings.Builder
+			for end < len(text) && text[end] != character {
+				if text[end] == '\\' && end+1 < len(text) {
+					end++
+				}
+				value.WriteByte(text[end])
+				end++
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string at position %d", position)
+			}
+			tokens = append(tokens, policyToken{kind: tokenString, text: value.String(), position: position})
+			position = end + 1
+		case character == '`':
+			end := strings.IndexByte(text[position+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated claim name at position %d", position)
+			}
+			tokens = append(tokens, policyToken{kind: tokenClaim, text: text[position+1 : position+1+end], position: position})
+			position += end + 2
+		case character == '-' || (character >= '0' && character <= '9'):
+			end := position + 1
+			for end < len(text) && (text[end] == '.' || (text[end] >= '0' && text[end] <= '9')) {
+				end++
+			}
+			tokens = append(tokens, policyToken{kind: tokenNumber, text: text[position:end], position: position})
+			position = end
+		case character == '.' || isIdentifierStart(character):
+			end := position + 1
+			for end < len(text) && isIdentifierPart(text[end]) {
+				end++
+			}
+			kind := tokenIdentifier
+			if character == '.' {
+				kind = tokenVariable
+			}
+			tokens = append(tokens, policyToken{kind: kind, text: text[position:end], position: position})
+			position = end
+		default:
+			matched := false
+			for _, operator := range policyOperators {
+				if strings.HasPrefix(text[position:], operator) {
+					tokens = append(tokens, policyToken{kind: tokenOperator, text: operator, position: position})
+					position += len(operator)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", character, position)
+			}
+		}
+	}
+	return append(tokens, policyToken{kind: tokenEnd, position: position}), nil
+}
+
+// isIdentifierStart returns true if the character may start a claim name.
+func isIdentifierStart(character byte) bool {
+	return character == '_' || (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z')
+}
+
+// isIdentifierPart returns true if the character may continue a claim name or variable, which may be a dotted claim path.
+func isIdentifierPart(character byte) bool {
+	return isIdentifierStart(character) || (character >= '0' && character <= '9') || character == '.' || character == '-' || character == ':'
+}
+
+// policyParser is a recursive descent parser for policies, in increasing order of precedence: ||, &&, !, comparisons and primary expressions.
+type policyParser struct {
+	tokens   []policyToken
+	position int
+}
+
+// peek returns the next token without consuming it.
+func (parser *policyParser) peek() policyToken {
+	return parser.tokens[parser.position]
+}
+
+// next consumes and returns the next token.
+func (parser *policyParser) next() policyToken {
+	token := parser.tokens[parser.position]
+	if token.kind != tokenEnd {
+		parser.position++
+	}
+	return token
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (parser *policyParser) accept(text string) bool {
+	token := parser.peek()
+	if (token.kind == tokenOperator || token.kind == tokenIdentifier) && token.text == text {
+		parser.position++
+		return true
+	}
+	return false
+}
+
+// expect consumes the next token, returning an error if it is not the given operator.
+func (parser *policyParser) expect(text string) error {
+	if !parser.accept(text) {
+		return fmt.Errorf("expected %q but got %s at position %d", text, parser.peek(), parser.peek().position)
+	}
+	return nil
+}
+
+// parseOr parses a sequence of expressions separated by ||.
+func (parser *policyParser) parseOr() (expression, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.accept("||") {
+		var right expression
+		right, err = parser.parseAnd()
+		left = orExpression{left, right}
+	}
+	return left, err
+}
+
+// parseAnd parses a sequence of expressions separated by &&.
+func (parser *policyParser) parseAnd() (expression, error) {
+	left, err := parser.parseNot()
+	for err == nil && parser.accept("&&") {
+		var right expression
+		right, err = parser.parseNot()
+		left = andExpression{left, right}
+	}
+	return left, err
+}
+
+// parseNot parses an optionally negated expression.
+func (parser *policyParser) parseNot() (expression, error) {
+	if parser.accept("!") {
+		operand, err := parser.parseNot()
+		return notExpression{operand}, err
+	}
+	return parser.parseComparison()
+}
+
+// parseComparison parses an expression optionally compared to another.
+func (parser *policyParser) parseComparison() (expression, error) {
+	left, err := parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if parser.accept(operator) {
+			right, err := parser.parsePrimary()
+			return comparisonExpression{operator: operator, left: left, right: right}, err
+		}
+	}
+	return left, nil
+}
+
+// parsePrimary parses a literal, claim, variable, list or parenthesized expression.
+func (parser *policyParser) parsePrimary() (expression, error) {
+	token := parser.next()
+	switch token.kind {
+	case tokenString:
+		return literalExpression{token.text}, nil
+	case tokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at position %d", token, token.position)
+		}
+		return literalExpression{number}, nil
+	case tokenVariable:
+		return compileVariable(token)
+	case tokenClaim:
+		return claimExpression{token.text}, nil
+	case tokenIdentifier:
+		switch token.text {
+		case "true":
+			return literalExpression{true}, nil
+		case "false":
+			return literalExpression{false}, nil
+		case "null":
+			return literalExpression{nil}, nil
+		case "in":
+			return nil, fmt.Errorf("unexpected %s at position %d", token, token.position)
+		}
+		return claimExpression{token.text}, nil
+	case tokenOperator:
+		switch token.text {
+		case "(":
+			inner, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, parser.expect(")")
+		case "[":
+			var elements []expression
+			for !parser.accept("]") {
+				if len(elements) > 0 {
+					if err := parser.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				element, err := parser.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, element)
+			}
+			return listExpression{elements}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", token, token.position)
+}
+
+// compileVariable checks that the variable names a TemplateVariables field, so that typos are reported when the policy is compiled.
+func compileVariable(token policyToken) (expression, error) {
+	path := strings.Split(token.text[1:], ".")
+	if field, ok := reflect.TypeOf(TemplateVariables{}).FieldByName(path[0]); !ok || !field.IsExported() {
+		return nil, fmt.Errorf("unknown variable %s at position %d", token, token.position)
+	}
+	return variableExpression{path}, nil
+}
+
+// literalExpression evaluates to a string, number, boolean or null literal.
+type literalExpression struct {
+	value interface{}
+}
+
+func (expression literalExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	return expression.value
+}
+
+// claimExpression evaluates to the value of a claim, which may be a claim path, or null if it is not present.
+type claimExpression struct {
+	name string
+}
+
+func (expression claimExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	value, _ := lookupClaim(claims, expression.name)
+	return value
+}
+
+// variableExpression evaluates to a TemplateVariables field, optionally indexed by map key, e.g. .Host.
+type variableExpression struct {
+	path []string
+}
+
+func (expression variableExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	value := reflect.ValueOf(variables).Elem().FieldByName(expression.path[0])
+	for _, segment := range expression.path[1:] {
+		if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		if value.Type() == reflect.TypeOf(http.Header{}) {
+			segment = http.CanonicalHeaderKey(segment)
+		}
+		value = value.MapIndex(reflect.ValueOf(segment).Convert(value.Type().Key()))
+		if !value.IsValid() {
+			return nil
+		}
+	}
+	// Multi-valued variables such as headers are reduced to their first value
+	if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String {
+		if value.Len() == 0 {
+			return nil
+		}
+		value = value.Index(0)
+	}
+	if value.Kind() == reflect.String {
+		return value.String()
+	}
+	return value.Interface()
+}
+
+// listExpression evaluates to a list literal.
+type listExpression struct {
+	elements []expression
+}
+
+func (expression listExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	values := make([]interface{}, len(expression.elements))
+	for index, element := range expression.elements {
+		values[index] = element.evaluate(claims, variables)
+	}
+	return values
+}
+
+// notExpression evaluates to the negation of its operand.
+type notExpression struct {
+	operand expression
+}
+
+func (expression notExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	return !truthy(expression.operand.evaluate(claims, variables))
+}
+
+// andExpression evaluates to true if both operands are.
+type andExpression struct {
+	left, right expression
+}
+
+func (expression andExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	return truthy(expression.left.evaluate(claims, variables)) && truthy(expression.right.evaluate(claims, variables))
+}
+
+// orExpression evaluates to true if either operand is.
+type orExpression struct {
+	left, right expression
+}
+
+func (expression orExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	return truthy(expression.left.evaluate(claims, variables)) || truthy(expression.right.evaluate(claims, variables))
+}
+
+// comparisonExpression evaluates to the result of comparing its operands.
+type comparisonExpression struct {
+	operator    string
+	left, right expression
+}
+
+func (expression comparisonExpression) evaluate(claims map[string]interface{}, variables *TemplateVariables) interface{} {
+	left := expression.left.evaluate(claims, variables)
+	right := expression.right.evaluate(claims, variables)
+	switch expression.operator {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	case "in":
+		return isIn(left, right)
+	}
+
+	// Ordering comparisons are only defined between two numbers or two strings
+	var order int
+	switch left := left.(type) {
+	case float64:
+		right, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		if left < right {
+			order = -1
+		} else if left > right {
+			order = 1
+		}
+	case string:
+		right, ok := right.(string)
+		if !ok {
+			return false
+		}
+		order = strings.Compare(left, right)
+	default:
+		return false
+	}
+	switch expression.operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// isIn returns true if value is an element of an array, a key of an object or one of the space-delimited words of a string (such as a scope claim).
+func isIn(value interface{}, container interface{}) bool {
+	switch container := container.(type) {
+	case []interface{}:
+		for _, element := range container {
+			if reflect.DeepEqual(value, element) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		if value, ok := value.(string); ok {
+			_, ok := container[value]
+			return ok
+		}
+	case string:
+		if value, ok := value.(string); ok {
+			for _, word := range strings.Fields(container) {
+				if word == value {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// truthy returns the boolean interpretation of a value: false, null, zero, and empty strings, arrays and objects are false.
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) != 0
+	case map[string]interface{}:
+		return len(value) != 0
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// operators are the keys of a structured requirement, e.g. {regex: "^emp-[0-9]+$"} or {gte: 3}.
+var operators = map[string]bool{
+	"regex": true, "gt": true, "gte": true, "lt": true, "lte": true,
+	"before": true, "after": true, "within": true, "contains": true, "allOf": true,
+}
+
+// RegexRequirement is a requirement for a string claim that must match a regular expression.
+type RegexRequirement struct {
+	regex *regexp.Regexp
+}
+
+// ComparisonRequirement is a requirement for a numeric claim that must compare to a value, e.g. an assurance level.
+type ComparisonRequirement struct {
+	operator string
+	value    float64
+}
+
+// TimeRequirement is a requirement for a timestamp claim that must be before or after a fixed time, or within a duration of now.
+type TimeRequirement struct {
+	before time.Time
+	after  time.Time
+	within time.Duration
+}
+
+// ContainsRequirement is a requirement for an array claim that must contain a value, or a string claim that must contain a substring.
+type ContainsRequirement struct {
+	value interface{}
+}
+
+// AllOfRequirement is a requirement for an array claim that must contain every one of the values.
+type AllOfRequirement struct {
+	values []interface{}
+}
+
+// AllRequirement is satisfied only if all of its requirements are, e.g. for {gte: 1, lte: 3}.
+type AllRequirement struct {
+	requirements []Requirement
+}
+
+// isOperatorMap returns true if every key of the map is a known operator, so that it's a structured requirement rather than a nested requirement.
+func isOperatorMap(value map[string]interface{}) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for key := range value {
+		if !operators[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// createOperatorRequirement compiles a structured requirement, combining multiple operators with AND.
+func createOperatorRequirement(value map[string]interface{}) (Requirement, error) {
+	// Sort the operators so that compilation errors are reported consistently
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	requirements := make([]Requirement, 0, len(value))
+	for _, operator := range keys {
+		requirement, err := createOperator(operator, value[operator])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s requirement: %w", operator, err)
+		}
+		requirements = append(requirements, requirement)
+	}
+	if len(requirements) == 1 {
+		return requirements[0], nil
+	}
+	return AllRequirement{requirements: requirements}, nil
+}
+
+// createOperator compiles a single operator of a structured requirement.
+func createOperator(operator string, value interface{}) (Requirement, error) {
+	switch operator {
+	case "regex":
+		pattern, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return RegexRequirement{regex: regex}, nil
+	case "gt", "gte", "lt", "lte":
+		number, ok := toNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return ComparisonRequirement{operator: operator, value: number}, nil
+	case "before", "after":
+		instant, ok := toTime(value)
+		if !ok {
+			return nil, fmt.Errorf("must be an RFC 3339 time, a date or a number of seconds since the epoch")
+		}
+		if operator == "before" {
+			return TimeRequirement{before: instant}, nil
+		}
+		return TimeRequirement{after: instant}, nil
+	case "within":
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a duration such as 15m")
+		}
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return nil, err
+		}
+		return TimeRequirement{within: duration}, nil
+	case "contains":
+		return ContainsRequirement{value: normalizeNumber(value)}, nil
+	case "allOf":
+		values, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("must be a list")
+		}
+		normalized := make([]interface{}, len(values))
+		for index, value := range values {
+			normalized[index] = normalizeNumber(value)
+		}
+		return AllOfRequirement{values: normalized}, nil
+	}
+	return nil, fmt.Errorf("unknown operator")
+}
+
+// Validate checks that value, or any element of an array value, matches the regular expression.
+func (requirement RegexRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	return anyElement(value, func(value interface{}) bool {
+		text, ok := value.(string)
+		return ok && requirement.regex.MatchString(text)
+	})
+}
+
+// Validate checks that value, or any element of an array value, is a number that compares to the requirement.
+func (requirement ComparisonRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	return anyElement(value, func(value interface{}) bool {
+		number, ok := toNumber(value)
+		if !ok {
+			return false
+		}
+		switch requirement.operator {
+		case "gt":
+			return number > requirement.value
+		case "gte":
+			return number >= requirement.value
+		case "lt":
+			return number < requirement.value
+		default:
+			return number <= requirement.value
+		}
+	})
+}
+
+// Validate checks that value is a timestamp (seconds since the epoch or RFC 3339) satisfying the requirement.
+func (requirement TimeRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	instant, ok := toTime(value)
+	if !ok {
+		return false
+	}
+	switch {
+	case !requirement.before.IsZero():
+		return instant.Before(requirement.before)
+	case !requirement.after.IsZero():
+		return instant.After(requirement.after)
+	default:
+		return variables.time().Sub(instant).Abs() <= requirement.within
+	}
+}
+
+// Validate checks that an array value contains the required value, or that a string value contains the required substring.
+func (requirement ContainsRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, element := range value {
+			if reflect.DeepEqual(element, requirement.value) {
+				return true
+			}
+		}
+	case string:
+		required, ok := requirement.value.(string)
+		return ok && strings.Contains(value, required)
+	}
+	return false
+}
+
+// Validate checks that an array value contains every one of the required values.
+func (requirement AllOfRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	values, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, required := range requirement.values {
+		if !(ContainsRequirement{value: required}).Validate(values, variables) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the value satisfies every requirement.
+func (requirement AllRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	for _, requirement := range requirement.requirements {
+		if !requirement.Validate(value, variables) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyElement returns true if match is true for the value, or for any element if the value is an array.
+func anyElement(value interface{}, match func(interface{}) bool) bool {
+	if values, ok := value.([]interface{}); ok {
+		for _, value := range values {
+			if match(value) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(value)
+}
+
+// toNumber converts a configuration or claim value to a float64, accepting strings as configuration from labels may not be typed.
+func toNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case string:
+		number, err := strconv.ParseFloat(value, 64)
+		return number, err == nil && !math.IsNaN(number)
+	}
+	return 0, false
+}
+
+// normalizeNumber converts integer configuration values to float64 so that they compare equal to JSON numbers in claims.
+func normalizeNumber(value interface{}) interface{} {
+	switch value.(type) {
+	case int, int64, uint64:
+		number, _ := toNumber(value)
+		return number
+	}
+	return value
+}
+
+// toTime converts a number of seconds since the epoch, an RFC 3339 time or a date to a time.
+func toTime(value interface{}) (time.Time, bool) {
+	if text, ok := value.(string); ok {
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if instant, err := time.Parse(layout, text); err == nil {
+				return instant, true
+			}
+		}
+	}
+	seconds, ok := toNumber(value)
+	if !ok {
+		return time.Time{}, false
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)), true
+}
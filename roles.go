@@ -0,0 +1,110 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultRoleClaims are the claims from which a token's roles are read when none are configured.
+var DefaultRoleClaims = []string{"roles", "groups"}
+
+// RoleConfig is the configuration for a role: the other roles that it implies and the permissions that it grants.
+type RoleConfig struct {
+	Implies     []string `json:"implies,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// setupRoles resolves the roles implied by each role, returning the full set of permissions granted by each.
+func setupRoles(roles map[string]RoleConfig) (map[string][]string, error) {
+	for role, config := range roles {
+		for _, implied := range config.Implies {
+			if _, ok := roles[implied]; !ok {
+				return nil, fmt.Errorf("role %s implies unknown role %s", role, implied)
+			}
+		}
+	}
+
+	permissions := make(map[string][]string, len(roles))
+	for role := range roles {
+		granted := make(map[string]bool)
+		collectPermissions(roles, role, make(map[string]bool), granted)
+		permissions[role] = sortedKeys(granted)
+	}
+	return permissions, nil
+}
+
+// collectPermissions adds the permissions of the role and of all the roles it implies, directly or indirectly, to granted. Cycles are ignored.
+func collectPermissions(roles map[string]RoleConfig, role string, visited map[string]bool, granted map[string]bool) {
+	if visited[role] {
+		return
+	}
+	visited[role] = true
+	for _, permission := range roles[role].Permissions {
+		granted[permission] = true
+	}
+	for _, implied := range roles[role].Implies {
+		collectPermissions(roles, implied, visited, granted)
+	}
+}
+
+// applyRoles returns the claims with the permissions granted by the token's roles added to the permissions claim, along with any permissions already present.
+// The claims are copied rather than modified, as they may be shared with the token cache.
+func (validator *Validator) applyRoles(claims jwt.MapClaims) jwt.MapClaims {
+	if len(validator.rolePermissions) == 0 {
+		return claims
+	}
+
+	granted := make(map[string]bool)
+	addStrings(granted, claims[validator.permissionsClaim])
+	for _, claim := range validator.roleClaims {
+		value, ok := lookupClaim(claims, claim)
+		if !ok {
+			continue
+		}
+		roles := make(map[string]bool)
+		addStrings(roles, value)
+		for role := range roles {
+			for _, permission := range validator.rolePermissions[role] {
+				granted[permission] = true
+			}
+		}
+	}
+
+	copied := make(jwt.MapClaims, len(claims)+1)
+	for key, value := range claims {
+		copied[key] = value
+	}
+	permissions := sortedKeys(granted)
+	values := make([]interface{}, len(permissions))
+	for index, permission := range permissions {
+		values[index] = permission
+	}
+	copied[validator.permissionsClaim] = values
+	return copied
+}
+
+// addStrings adds a string value, or the strings in an array value, to the set.
+func addStrings(set map[string]bool, value interface{}) {
+	switch value := value.(type) {
+	case string:
+		set[value] = true
+	case []interface{}:
+		for _, value := range value {
+			if value, ok := value.(string); ok {
+				set[value] = true
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of the set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
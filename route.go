@@ -0,0 +1,102 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routePattern is a compiled route pattern such as /tenants/{tenant}/..., used to extract named parameters from the request path.
+type routePattern struct {
+	segments []string // Literal segments, {name} parameters or * to match any single segment
+	rest     bool     // Whether the pattern ends with ... to match any remaining segments
+}
+
+// compileRoutePatterns compiles the configured route patterns.
+func compileRoutePatterns(patterns []string) ([]routePattern, error) {
+	compiled := make([]routePattern, len(patterns))
+	for index, pattern := range patterns {
+		route, err := compileRoutePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route pattern %s: %w", pattern, err)
+		}
+		compiled[index] = route
+	}
+	return compiled, nil
+}
+
+// compileRoutePattern splits a route pattern into segments and checks that its parameters are well formed.
+func compileRoutePattern(pattern string) (routePattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return routePattern{}, fmt.Errorf("must begin with /")
+	}
+	var route routePattern
+	segments := strings.Split(pattern[1:], "/")
+	for index, segment := range segments {
+		if segment == "..." {
+			if index != len(segments)-1 {
+				return routePattern{}, fmt.Errorf("... must be the last segment")
+			}
+			route.rest = true
+			break
+		}
+		if strings.HasPrefix(segment, "{") || strings.HasSuffix(segment, "}") {
+			if len(segment) < 3 || !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+				return routePattern{}, fmt.Errorf("bad parameter %s", segment)
+			}
+		}
+		route.segments = append(route.segments, segment)
+	}
+	return route, nil
+}
+
+// match returns the parameters of the route if it matches the escaped request path. Each segment is unescaped separately, and paths with
+// segments that are . or .. or contain an encoded / never match, as a backend routing on the raw path would see different parameters.
+func (route routePattern) match(escapedPath string) (map[string]string, bool) {
+	segments := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	if len(segments) < len(route.segments) || (!route.rest && len(segments) != len(route.segments)) {
+		return nil, false
+	}
+	for index, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || decoded == "." || decoded == ".." || strings.Contains(decoded, "/") {
+			return nil, false
+		}
+		segments[index] = decoded
+	}
+	parameters := make(map[string]string)
+	for index, segment := range route.segments {
+		switch {
+		case strings.HasPrefix(segment, "{"):
+			parameters[segment[1:len(segment)-1]] = segments[index]
+		case segment != "*" && segment != segments[index]:
+			return nil, false
+		}
+	}
+	return parameters, true
+}
+
+// matchRoute returns the parameters of the first route pattern that matches the request path, or nil if none do.
+func (validator *Validator) matchRoute(requestURL *url.URL) map[string]string {
+	escapedPath := requestURL.EscapedPath()
+	for _, route := range validator.routePatterns {
+		if parameters, ok := route.match(escapedPath); ok {
+			return parameters
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client, preferring the X-Real-Ip header set by Traefik to the address of the connection, which may be a proxy.
+func clientIP(request *http.Request) string {
+	if ip := request.Header.Get("X-Real-Ip"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,209 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/danwakefield/fnmatch"
+)
+
+// RuleConfig is the configuration for an authorization rule that applies to the requests matching its paths, prefixes, methods and hosts.
+type RuleConfig struct {
+	Paths        []string               `json:"paths,omitempty"`
+	Prefixes     []string               `json:"prefixes,omitempty"`
+	Methods      []string               `json:"methods,omitempty"`
+	Hosts        []string               `json:"hosts,omitempty"`
+	Require      map[string]interface{} `json:"require,omitempty"`
+	Deny         map[string]interface{} `json:"deny,omitempty"`
+	Optional     bool                   `json:"optional,omitempty"`
+	Policy       string                 `json:"policy,omitempty"`
+	ACR          []string               `json:"acr,omitempty"`
+	AMR          []string               `json:"amr,omitempty"`
+	MaxAge       int64                  `json:"maxAge,omitempty"`
+	MintAudience string                 `json:"mintAudience,omitempty"`
+}
+
+// Rule is a compiled authorization rule. An empty list of paths and prefixes, methods or hosts matches any request.
+type Rule struct {
+	Index        int // The index of the rule in the rules configuration, or -1 for the default rule
+	paths        []string
+	prefixes     []string
+	methods      []string
+	hosts        []string
+	require      map[string][]Requirement
+	deny         map[string][]Requirement
+	optional     bool
+	policy       *Policy
+	acr          []string
+	amr          []string
+	maxAge       int64
+	mintAudience string
+}
+
+// compileRule compiles the requirements, deny rules and policy of a rule.
+func compileRule(config RuleConfig, scopeClaims []string, matchers map[string]Matcher) (*Rule, error) {
+	require, err := convertRequire(config.Require, scopeClaims, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := convertRequire(config.Deny, scopeClaims, matchers)
+	if err != nil {
+		return nil, fmt.Errorf("deny %w", err)
+	}
+
+	var policy *Policy
+	if config.Policy != "" {
+		policy, err = CompilePolicy(config.Policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	methods := make([]string, len(config.Methods))
+	for index, method := range config.Methods {
+		methods[index] = strings.ToUpper(method)
+	}
+	hosts := make([]string, len(config.Hosts))
+	for index, host := range config.Hosts {
+		hosts[index] = strings.ToLower(host)
+	}
+
+	return &Rule{
+		paths:        config.Paths,
+		prefixes:     config.Prefixes,
+		methods:      methods,
+		hosts:        hosts,
+		require:      require,
+		deny:         deny,
+		optional:     config.Optional,
+		policy:       policy,
+		acr:          config.ACR,
+		amr:          config.AMR,
+		maxAge:       config.MaxAge,
+		mintAudience: config.MintAudience,
+	}, nil
+}
+
+// compileRules compiles the configured rules followed by a default rule from the top-level configuration, which matches every request.
+func compileRules(config *Config) ([]*Rule, error) {
+	scopeClaims := withDefault(config.ScopeClaims, DefaultScopeClaims)
+	matchers, err := createMatchers(config.Matching)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0, len(config.Rules)+1)
+	for index, ruleConfig := range config.Rules {
+		rule, err := compileRule(ruleConfig, scopeClaims, matchers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", index, err)
+		}
+		rule.Index = index
+		rules = append(rules, rule)
+	}
+
+	rule, err := compileRule(RuleConfig{
+		Require:  config.Require,
+		Deny:     config.Deny,
+		Optional: config.Optional,
+		Policy:   config.Policy,
+		ACR:      config.ACR,
+		AMR:      config.AMR,
+		MaxAge:   config.MaxAge,
+	}, scopeClaims, matchers)
+	if err != nil {
+		return nil, err
+	}
+	rule.Index = -1
+	return append(rules, rule), nil
+}
+
+// matchRule returns the first rule that matches the request. The last rule is the default rule, which always matches.
+func (validator *Validator) matchRule(request *http.Request, variables *TemplateVariables) *Rule {
+	requestPath := cleanPath(request.URL.Path)
+	host := requestHost(variables.Host)
+	for _, rule := range validator.rules {
+		if rule.Matches(request.Method, requestPath, host) {
+			return rule
+		}
+	}
+	return validator.rules[len(validator.rules)-1]
+}
+
+// Matches returns true if the rule applies to a request with the given method, cleaned path and host.
+func (rule *Rule) Matches(method string, requestPath string, host string) bool {
+	if len(rule.methods) != 0 && !contains(rule.methods, method) {
+		return false
+	}
+
+	if len(rule.hosts) != 0 {
+		matched := false
+		for _, pattern := range rule.hosts {
+			if fnmatch.Match(pattern, host, 0) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.paths) == 0 && len(rule.prefixes) == 0 {
+		return true
+	}
+	for _, pattern := range rule.paths {
+		if fnmatch.Match(pattern, requestPath, 0) {
+			return true
+		}
+	}
+	for _, prefix := range rule.prefixes {
+		if strings.HasPrefix(requestPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath resolves any . and .. segments and repeated slashes in the path, so that they can't be used to select a less restrictive rule.
+// A trailing slash is kept so that it can be matched by a pattern or prefix. Paths that a backend could resolve differently are rejected
+// beforehand by ambiguousPath.
+func cleanPath(requestPath string) string {
+	if requestPath == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// ambiguousPath returns true if a segment of the escaped path contains an encoded / or a \, or is an encoded . or .. segment. The decoded
+// path would then be cleaned differently from the path received by a backend that routes on the raw path, so for example /admin/..%2Fpublic
+// would match the rules for /public while being served under /admin.
+func ambiguousPath(requestURL *url.URL) bool {
+	for _, segment := range strings.Split(requestURL.EscapedPath(), "/") {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || strings.ContainsAny(decoded, `/\`) {
+			return true
+		}
+		if (decoded == "." || decoded == "..") && decoded != segment {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lowercased host of the request without any port.
+func requestHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(host)
+}
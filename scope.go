@@ -0,0 +1,148 @@
+package jwt_middleware
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// DefaultScopeClaims are the claims treated as space-delimited OAuth scopes when none are configured.
+var DefaultScopeClaims = []string{"scope", "scp"}
+
+// Challenge is implemented by errors that should be reported to API clients with a WWW-Authenticate header.
+type Challenge interface {
+	error
+	Challenge() string
+}
+
+// InsufficientScopeError is returned when a token does not grant the scopes required, as per RFC 6750.
+type InsufficientScopeError struct {
+	Claim  string
+	Scopes []string // The acceptable alternatives, each of which is a space-delimited list of scopes that must all be granted
+}
+
+// Error returns the error message.
+func (err *InsufficientScopeError) Error() string {
+	return fmt.Sprintf("insufficient scope: %s", strings.Join(err.Scopes, " or "))
+}
+
+// Challenge returns the WWW-Authenticate header value for the error. The scope attribute can only express a single set of scopes,
+// so is omitted if there are alternatives, rather than telling the client of only one of them.
+func (err *InsufficientScopeError) Challenge() string {
+	if len(err.Scopes) != 1 {
+		return `Bearer error="insufficient_scope"`
+	}
+	return fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, err.Scopes[0])
+}
+
+// ScopeRequirement is a requirement for a scope claim, which is satisfied if the claim grants all of the required scopes.
+// A templated requirement is interpolated per request before being split into scopes.
+type ScopeRequirement struct {
+	scopes   []string
+	template *template.Template
+}
+
+// Validate checks that every required scope is present in value, which may be a space-delimited string or an array of scopes.
+func (requirement ScopeRequirement) Validate(value interface{}, variables *TemplateVariables) bool {
+	granted := make(map[string]bool)
+	switch value := value.(type) {
+	case string:
+		for _, scope := range strings.Fields(value) {
+			granted[scope] = true
+		}
+	case []interface{}:
+		for _, scope := range value {
+			if scope, ok := scope.(string); ok {
+				for _, scope := range strings.Fields(scope) {
+					granted[scope] = true
+				}
+			}
+		}
+	default:
+		return false
+	}
+
+	required := requirement.expand(variables)
+	if len(required) == 0 {
+		// A template that interpolates to nothing must not match every token
+		return false
+	}
+	for _, scope := range required {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// expand returns the required scopes, interpolating the template with the variables if the requirement is templated.
+func (requirement ScopeRequirement) expand(variables *TemplateVariables) []string {
+	if requirement.template == nil {
+		return requirement.scopes
+	}
+	var buffer bytes.Buffer
+	err := requirement.template.Execute(&buffer, variables)
+	if err != nil {
+		variables.logf("Error executing template: %s", err)
+		return nil
+	}
+	return strings.Fields(buffer.String())
+}
+
+// convertScopeRequire converts the requirement for a scope claim. A space-delimited string requires all of its scopes, while a list of strings requires any one of them.
+// It returns nil if the value is not a string or a list, and an error for a requirement without scopes, which would otherwise match every token.
+func convertScopeRequire(value interface{}) ([]Requirement, error) {
+	switch value := value.(type) {
+	case string:
+		requirement, err := createScopeRequirement(value)
+		if err != nil {
+			return nil, err
+		}
+		return []Requirement{requirement}, nil
+	case []interface{}:
+		requirements := make([]Requirement, 0, len(value))
+		for _, value := range value {
+			if value, ok := value.(string); ok {
+				requirement, err := createScopeRequirement(value)
+				if err != nil {
+					return nil, err
+				}
+				requirements = append(requirements, requirement)
+			}
+		}
+		return requirements, nil
+	}
+	return nil, nil
+}
+
+// createScopeRequirement creates a ScopeRequirement from a space-delimited string of scopes, which may be a template.
+func createScopeRequirement(value string) (ScopeRequirement, error) {
+	if strings.TrimSpace(value) == "" {
+		return ScopeRequirement{}, fmt.Errorf("empty scope requirement")
+	}
+	if strings.Contains(value, "{{") && strings.Contains(value, "}}") {
+		parsed, err := template.New("template").Parse(value)
+		if err != nil {
+			return ScopeRequirement{}, err
+		}
+		return ScopeRequirement{template: parsed}, nil
+	}
+	return ScopeRequirement{scopes: strings.Fields(value)}, nil
+}
+
+// scopeError returns an InsufficientScopeError for the claim listing the acceptable alternatives if it's a scope claim, or nil if not.
+func scopeError(claim string, requirements []Requirement, variables *TemplateVariables) error {
+	scopes := make([]string, 0, len(requirements))
+	for _, requirement := range requirements {
+		requirement, ok := requirement.(ScopeRequirement)
+		if !ok {
+			return nil
+		}
+		scopes = append(scopes, strings.Join(requirement.expand(variables), " "))
+	}
+	if len(scopes) == 0 {
+		return nil
+	}
+	return &InsufficientScopeError{Claim: claim, Scopes: scopes}
+}
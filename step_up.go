@@ -0,0 +1,75 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// StepUpError is returned when an otherwise valid token does not meet the authentication requirements (acr, amr or max age) of the request,
+// so that the user must authenticate again at a higher level, as per RFC 9470.
+type StepUpError struct {
+	Reason    string
+	ACRValues []string
+	MaxAge    int64
+	LoginHint string
+}
+
+// Error returns the error message.
+func (err *StepUpError) Error() string {
+	return fmt.Sprintf("insufficient user authentication: %s", err.Reason)
+}
+
+// Challenge returns the WWW-Authenticate header value for the error.
+func (err *StepUpError) Challenge() string {
+	challenge := `Bearer error="insufficient_user_authentication", error_description="A different authentication level is required"`
+	if len(err.ACRValues) != 0 {
+		challenge += fmt.Sprintf(`, acr_values="%s"`, strings.Join(err.ACRValues, " "))
+	}
+	if err.MaxAge != 0 {
+		challenge += fmt.Sprintf(`, max_age="%d"`, err.MaxAge)
+	}
+	return challenge
+}
+
+// validateAuthentication checks that the token's acr is one of those accepted by the rule, that its amr includes all of the methods required by the rule
+// and that its auth_time is within the rule's maximum age.
+func (validator *Validator) validateAuthentication(rule *Rule, claims jwt.MapClaims) error {
+	var reason string
+	if len(rule.acr) != 0 {
+		acr, _ := claims["acr"].(string)
+		if !contains(rule.acr, acr) {
+			reason = "acr"
+		}
+	}
+	if reason == "" && len(rule.amr) != 0 {
+		amr := make(map[string]bool)
+		addStrings(amr, claims["amr"])
+		for _, method := range rule.amr {
+			if !amr[method] {
+				reason = "amr"
+				break
+			}
+		}
+	}
+	if reason == "" && rule.maxAge != 0 {
+		authTime, ok := claims["auth_time"].(float64)
+		if !ok || validator.now().Unix()-int64(authTime) > rule.maxAge {
+			reason = "max age"
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+
+	loginHint, _ := claims[validator.loginHintClaim].(string)
+	return &StepUpError{Reason: reason, ACRValues: rule.acr, MaxAge: rule.maxAge, LoginHint: loginHint}
+}
+
+// queryEscape escapes the value for use in a query parameter of a redirect template. Spaces are escaped as %20 rather than +, which the
+// template would otherwise escape again.
+func queryEscape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
@@ -0,0 +1,72 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ProfileRFC9068 is the JWT profile for OAuth 2.0 access tokens defined in RFC 9068.
+const ProfileRFC9068 = "rfc9068"
+
+// rfc9068Claims are the claims that RFC 9068 requires to be present in an access token.
+var rfc9068Claims = []string{"iss", "exp", "aud", "sub", "client_id", "iat", "jti"}
+
+// setupTokenTypes returns the allowed typ values for the given configuration, checking that the profile is known.
+func setupTokenTypes(config *Config) ([]string, error) {
+	switch strings.ToLower(config.Profile) {
+	case "":
+		return config.TokenTypes, nil
+	case ProfileRFC9068:
+		if len(config.TokenTypes) == 0 {
+			return []string{"at+jwt"}, nil
+		}
+		return config.TokenTypes, nil
+	default:
+		return nil, fmt.Errorf("unknown token profile: %s", config.Profile)
+	}
+}
+
+// validateTokenType checks the token's typ header and kind-specific claims against the configured token profile.
+func (validator *Validator) validateTokenType(token *jwt.Token) error {
+	if len(validator.tokenTypes) != 0 {
+		kind, _ := token.Header["typ"].(string)
+		if !isAllowedTokenType(validator.tokenTypes, kind) {
+			return fmt.Errorf("token typ is not allowed: %s", kind)
+		}
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if validator.rejectIDTokens {
+		for _, claim := range []string{"nonce", "at_hash"} {
+			if _, ok := claims[claim]; ok {
+				return fmt.Errorf("id tokens are not accepted")
+			}
+		}
+	}
+	if validator.rejectLogoutTokens {
+		if _, ok := claims["events"]; ok {
+			return fmt.Errorf("logout tokens are not accepted")
+		}
+	}
+	if validator.profile == ProfileRFC9068 {
+		for _, claim := range rfc9068Claims {
+			if _, ok := claims[claim]; !ok {
+				return fmt.Errorf("access token is missing required claim: %s", claim)
+			}
+		}
+	}
+	return nil
+}
+
+// isAllowedTokenType compares typ case-insensitively against the allowed values, ignoring any "application/" prefix as per RFC 7515.
+func isAllowedTokenType(allowed []string, kind string) bool {
+	kind = strings.TrimPrefix(strings.ToLower(kind), "application/")
+	for _, value := range allowed {
+		if strings.TrimPrefix(strings.ToLower(value), "application/") == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,378 @@
+package jwt_middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Validator validates the tokens of requests against the configuration, without modifying the requests. It can be used on its own by Go services,
+// while JWTPlugin adapts it to Traefik, acting on its decisions by rejecting or redirecting the request, or setting headers and forwarding it.
+type Validator struct {
+	parser                      *jwt.Parser
+	secret                      interface{}
+	issuers                     []string
+	rules                       []*Rule
+	lock                        sync.RWMutex
+	keys                        map[string]interface{}
+	issuerKeys                  map[string]map[string]interface{}
+	keyIssuers                  map[string]string
+	keyProviders                []KeyProvider
+	extractors                  []Extractor
+	freshness                   int64
+	decryptionKeys              []interface{}
+	keyManagementAlgorithms     []string
+	contentEncryptionAlgorithms []string
+	tokenTypes                  []string
+	rejectIDTokens              bool
+	rejectLogoutTokens          bool
+	profile                     string
+	criticalHeaders             []string
+	introspectionURL            string
+	introspectionClientID       string
+	introspectionClientSecret   string
+	introspectAll               bool
+	introspectionCacheTTL       int64
+	introspectionCache          *tokenCache
+	dpop                        bool
+	requireDPoP                 bool
+	dpopWindow                  int64
+	dpopParser                  *jwt.Parser
+	dpopLock                    sync.Mutex
+	dpopProofs                  map[string]time.Time
+	dpopPurged                  time.Time
+	certificateBinding          bool
+	requireCertificateBinding   bool
+	clientCertificateHeader     string
+	cache                       *tokenCache
+	routePatterns               []routePattern
+	rolePermissions             map[string][]string
+	roleClaims                  []string
+	permissionsClaim            string
+	claimMappings               []ClaimMapping
+	loginHintClaim              string
+	client                      *http.Client
+	logger                      *log.Logger
+	now                         func() time.Time
+}
+
+// Option is a functional option for NewValidator.
+type Option func(validator *Validator)
+
+// KeyProvider provides keys for verifying tokens in addition to those fetched from the configured issuers, such as keys held in a secrets manager.
+// Providers are consulted in order when no fetched key matches the token, before falling back to any fixed secret.
+type KeyProvider interface {
+	// Key returns the key with which to verify the token, or nil if the provider has no key for it.
+	Key(token *jwt.Token) (interface{}, error)
+}
+
+// KeyProviderFunc adapts a function to a KeyProvider.
+type KeyProviderFunc func(token *jwt.Token) (interface{}, error)
+
+// Key calls the function.
+func (function KeyProviderFunc) Key(token *jwt.Token) (interface{}, error) {
+	return function(token)
+}
+
+// WithHTTPClient sets the HTTP client used to fetch OpenID configurations and JWKS, and to introspect tokens. The default is http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(validator *Validator) {
+		validator.client = client
+	}
+}
+
+// WithLogger sets the logger. The default writes to the standard logger's output without timestamps, which Traefik adds itself.
+func WithLogger(logger *log.Logger) Option {
+	return func(validator *Validator) {
+		validator.logger = logger
+	}
+}
+
+// WithClock sets the function returning the current time, against which token expiry, freshness and authentication age are checked.
+func WithClock(now func() time.Time) Option {
+	return func(validator *Validator) {
+		validator.now = now
+	}
+}
+
+// WithExtractors sets the extractors with which tokens are found in requests, in order, replacing those configured.
+func WithExtractors(extractors ...Extractor) Option {
+	return func(validator *Validator) {
+		validator.extractors = extractors
+	}
+}
+
+// WithKeyProvider adds a KeyProvider.
+func WithKeyProvider(provider KeyProvider) Option {
+	return func(validator *Validator) {
+		validator.keyProviders = append(validator.keyProviders, provider)
+	}
+}
+
+// Reasons for rejecting a request, as given in Decision.
+const (
+	ReasonAmbiguousPath      = "ambiguous_path"
+	ReasonNoToken            = "no_token"
+	ReasonInvalidToken       = "invalid_token"
+	ReasonInvalidDPoP        = "invalid_dpop_proof"
+	ReasonCertificateBinding = "invalid_certificate_binding"
+	ReasonInsufficientScope  = "insufficient_scope"
+	ReasonClaimNotValid      = "claim_not_valid"
+	ReasonClaimDenied        = "claim_denied"
+	ReasonPolicy             = "policy_not_satisfied"
+	ReasonStepUp             = "insufficient_user_authentication"
+)
+
+// Decision is the outcome of validating a request.
+type Decision struct {
+	Status    int                // http.StatusOK if the request is allowed, otherwise the status with which to reject it
+	Reason    string             // One of the Reason constants if the request is rejected, or empty if it is allowed
+	Err       error              // The error describing why the request is rejected, or nil if it is allowed
+	Rule      *Rule              // The rule that matched the request
+	Result    *ValidationResult  // The verified token, or nil if there was no token or it could not be verified
+	Variables *TemplateVariables // The template variables of the request
+	extractor Extractor
+}
+
+// Allowed returns true if the request is allowed.
+func (decision *Decision) Allowed() bool {
+	return decision.Err == nil
+}
+
+// Claims returns the claims of the verified token, or nil if there is none.
+func (decision *Decision) Claims() jwt.MapClaims {
+	if decision.Result == nil {
+		return nil
+	}
+	return decision.Result.Claims
+}
+
+// reject sets the decision to reject the request with the status, reason and error.
+func (decision *Decision) reject(status int, reason string, err error) *Decision {
+	decision.Status = status
+	decision.Reason = reason
+	decision.Err = err
+	return decision
+}
+
+// NewValidator creates a new Validator from the configuration, as created by CreateConfig and then customized. Keys are prefetched from the issuers
+// that don't contain wildcards.
+func NewValidator(config *Config, options ...Option) (*Validator, error) {
+	secret, err := SetupSecret(config.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptionKeys, err := SetupDecryptionKeys(config.DecryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenTypes, err := setupTokenTypes(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := compileRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	routePatterns, err := compileRoutePatterns(config.RoutePatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	rolePermissions, err := setupRoles(config.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	claimMappings, err := setupClaimMappings(config.ClaimMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	extractors, err := setupExtractors(config)
+	if err != nil {
+		return nil, err
+	}
+
+	validator := Validator{
+		secret:                      secret,
+		issuers:                     canonicalizeDomains(config.Issuers),
+		rules:                       rules,
+		keys:                        make(map[string]interface{}),
+		issuerKeys:                  make(map[string]map[string]interface{}),
+		keyIssuers:                  make(map[string]string),
+		extractors:                  extractors,
+		freshness:                   config.Freshness,
+		decryptionKeys:              decryptionKeys,
+		keyManagementAlgorithms:     withDefault(config.KeyManagementAlgorithms, DefaultKeyManagementAlgorithms),
+		contentEncryptionAlgorithms: withDefault(config.ContentEncryptionAlgorithms, DefaultContentEncryptionAlgorithms),
+		tokenTypes:                  tokenTypes,
+		rejectIDTokens:              config.RejectIDTokens,
+		rejectLogoutTokens:          config.RejectLogoutTokens,
+		profile:                     strings.ToLower(config.Profile),
+		criticalHeaders:             config.CriticalHeaders,
+		introspectionURL:            config.IntrospectionURL,
+		introspectionClientID:       config.IntrospectionClientID,
+		introspectionClientSecret:   config.IntrospectionClientSecret,
+		introspectAll:               config.IntrospectAll,
+		introspectionCacheTTL:       config.IntrospectionCacheTTL,
+		introspectionCache:          newIntrospectionCache(config),
+		dpop:                        config.DPoP || config.RequireDPoP,
+		requireDPoP:                 config.RequireDPoP,
+		dpopWindow:                  config.DPoPWindow,
+		dpopProofs:                  make(map[string]time.Time),
+		certificateBinding:          config.CertificateBinding || config.RequireCertificateBinding,
+		requireCertificateBinding:   config.RequireCertificateBinding,
+		clientCertificateHeader:     config.ClientCertificateHeader,
+		cache:                       newTokenCache(config.CacheSize),
+		routePatterns:               routePatterns,
+		rolePermissions:             rolePermissions,
+		roleClaims:                  withDefault(config.RoleClaims, DefaultRoleClaims),
+		permissionsClaim:            config.PermissionsClaim,
+		claimMappings:               claimMappings,
+		loginHintClaim:              config.LoginHintClaim,
+		client:                      http.DefaultClient,
+		logger:                      log.New(log.Writer(), "", 0),
+		now:                         time.Now,
+	}
+	for _, option := range options {
+		option(&validator)
+	}
+	// The parsers are created after the options are applied so that they use the clock
+	validator.parser = jwt.NewParser(jwt.WithValidMethods(config.ValidMethods), jwt.WithTimeFunc(validator.now))
+	validator.dpopParser = jwt.NewParser(jwt.WithValidMethods(dpopMethods(config.ValidMethods)), jwt.WithTimeFunc(validator.now))
+
+	for _, issuer := range validator.issuers {
+		if strings.Contains(issuer, "*") {
+			continue
+		}
+		err := validator.fetchKeys(issuer)
+		if err != nil {
+			validator.logger.Printf("failed to prefetch keys for %s: %v", issuer, err)
+		}
+	}
+
+	return &validator, nil
+}
+
+// Validate validates the token of the request against the rule that matches it and returns the decision. The request is not modified.
+func (validator *Validator) Validate(request *http.Request) *Decision {
+	return validator.decide(request, validator.createTemplateVariables(request))
+}
+
+// decide validates the token of the request with the given template variables and returns the decision.
+func (validator *Validator) decide(request *http.Request, variables *TemplateVariables) *Decision {
+	rule := validator.matchRule(request, variables)
+	decision := &Decision{Status: http.StatusOK, Rule: rule, Variables: variables}
+	if ambiguousPath(request.URL) {
+		return decision.reject(http.StatusBadRequest, ReasonAmbiguousPath, fmt.Errorf("path contains encoded separators or dot segments"))
+	}
+
+	token, scheme, extractor := validator.extractToken(request)
+	if token == "" {
+		// No token provided
+		if !rule.optional {
+			return decision.reject(http.StatusUnauthorized, ReasonNoToken, fmt.Errorf("no token provided"))
+		}
+		return decision
+	}
+
+	var claims jwt.MapClaims
+	var header map[string]interface{}
+	var err error
+	if validator.shouldIntrospect(token) {
+		claims, err = validator.introspect(token)
+	} else {
+		claims, header, err = validator.parseToken(token)
+	}
+	if err != nil {
+		return decision.reject(http.StatusUnauthorized, ReasonInvalidToken, err)
+	}
+
+	err = validator.validateDPoP(request, variables, token, scheme, claims)
+	if err != nil {
+		return decision.reject(http.StatusUnauthorized, ReasonInvalidDPoP, err)
+	}
+
+	err = validator.validateCertificateBinding(request, claims)
+	if err != nil {
+		return decision.reject(http.StatusUnauthorized, ReasonCertificateBinding, err)
+	}
+
+	// Map claims from the issuer's representation, then add the permissions granted by the token's roles
+	claims = validator.mapClaims(claims)
+	claims = validator.applyRoles(claims)
+
+	keyID, _ := header["kid"].(string)
+	decision.Result = &ValidationResult{
+		Claims: claims,
+		Token:  token,
+		Header: header,
+		Issuer: validator.keyIssuer(header),
+		KeyID:  keyID,
+		Source: extractor.Source(),
+	}
+	decision.extractor = extractor
+
+	// Validate claims
+	for claim, requirements := range rule.require {
+		result := validator.ValidateClaim(claim, claims, requirements, variables)
+		if !result {
+			err := scopeError(claim, requirements, variables)
+			if err != nil {
+				return decision.reject(validator.forbidden(claims), ReasonInsufficientScope, err)
+			}
+			return decision.reject(validator.forbidden(claims), ReasonClaimNotValid, fmt.Errorf("claim is not valid: %s", claim))
+		}
+	}
+
+	// Reject tokens matching any deny rule. This is always a 403, as authenticating again won't change the claims that are denied.
+	for claim, requirements := range rule.deny {
+		if validator.ValidateClaim(claim, claims, requirements, variables) {
+			return decision.reject(http.StatusForbidden, ReasonClaimDenied, fmt.Errorf("claim is denied: %s", claim))
+		}
+	}
+
+	// Evaluate any policy expression
+	if rule.policy != nil && !rule.policy.Evaluate(claims, variables) {
+		return decision.reject(validator.forbidden(claims), ReasonPolicy, fmt.Errorf("policy is not satisfied"))
+	}
+
+	// Check the authentication level last, as there's no point asking the user to step up if they'd be denied anyway
+	err = validator.validateAuthentication(rule, claims)
+	if err != nil {
+		return decision.reject(http.StatusUnauthorized, ReasonStepUp, err)
+	}
+
+	return decision
+}
+
+// forbidden returns a 403, or a 401 if the token is older than our freshness window, as we allow that reauthorization might fix it.
+func (validator *Validator) forbidden(claims jwt.MapClaims) int {
+	iat, ok := claims["iat"].(float64)
+	if ok && validator.freshness != 0 && validator.now().Unix()-int64(iat) > validator.freshness {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+// newIntrospectionCache creates the cache of introspection results, or returns nil if caching is disabled.
+func newIntrospectionCache(config *Config) *tokenCache {
+	if config.IntrospectionURL == "" || config.IntrospectionCacheTTL <= 0 {
+		return nil
+	}
+	size := config.IntrospectionCacheSize
+	if size == 0 {
+		size = DefaultIntrospectionCacheSize
+	}
+	return newTokenCache(size)
+}